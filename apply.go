@@ -2,16 +2,11 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"log"
 
-	"github.com/docker/docker/api/client/bundlefile"
-	"github.com/docker/docker/api/client/stack"
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/fatih/color"
+	"github.com/mantika/whaleprint/engine"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
 )
@@ -25,7 +20,7 @@ func apply(c *cli.Context) error {
 
 	swarm, swarmErr := client.NewEnvClient()
 	if swarmErr != nil {
-		return cli.NewExitError(swarmErr.Error(), 3)
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
 	}
 
 	target := c.StringSlice("target")
@@ -35,113 +30,150 @@ func apply(c *cli.Context) error {
 		targetMap[name] = true
 	}
 
-	for _, stack := range stacks {
-		filter := filters.NewArgs()
-		filter.Add("label", "com.docker.stack.namespace="+stack.Name)
-		services, servicesErr := swarm.ServiceList(context.Background(), types.ServiceListOptions{Filters: filter})
-		if servicesErr != nil {
-			return cli.NewExitError(servicesErr.Error(), 3)
+	allowDestroy := getAllowDestroy(c)
+
+	if err := configureRedaction(c.StringSlice("redact")); err != nil {
+		return exitWithError(err)
+	}
+	autoApprove := c.Bool("auto-approve")
+
+	var registryAuth *engine.RegistryAuth
+	if c.Bool("with-registry-auth") {
+		registryAuth, err = engine.NewRegistryAuth()
+		if err != nil {
+			return exitWithError(err)
 		}
+	}
 
-		expected := getBundleServicesSpec(stack.Bundle, stack.Name)
-		translateNetworkToIds(&expected, swarm, stack.Name)
-		current := getSwarmServicesSpecForStack(services)
-
-		cyan := color.New(color.FgCyan)
-		for name, cs := range current {
-			if _, found := targetMap[cs.Spec.Name]; len(targetMap) == 0 || found {
-				if _, found := expected[name]; !found {
-					// service exists but it's not expected, need to delete it
-					cyan.Printf("Removing service %s\n", name)
-					servicesErr := swarm.ServiceRemove(context.Background(), name)
-					if servicesErr != nil {
-						return cli.NewExitError(servicesErr.Error(), 3)
-					}
-				}
-			}
+	resolver, err := getImageResolver(color.Output, c.String("resolve-image"), swarm)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitInvalid)
+	}
+
+	if c.BoolT("lock") {
+		release, err := lockStacks(color.Output, swarm, stacks, c.Duration("lock-timeout"))
+		if err != nil {
+			return exitWithError(err)
 		}
+		defer release()
+	}
 
-		err = updateNetworks(context.Background(), swarm, getUniqueNetworkNames(stack.Bundle.Services), stack.Name)
+	nodes, nodesErr := swarm.NodeList(context.Background(), types.NodeListOptions{})
+	if nodesErr != nil {
+		return cli.NewExitError(nodesErr.Error(), exitAPI)
+	}
+
+	live, liveErr := swarm.ServiceList(context.Background(), types.ServiceListOptions{})
+	if liveErr != nil {
+		return cli.NewExitError(liveErr.Error(), exitAPI)
+	}
 
+	plans := []*engine.StackPlan{}
+	changes := 0
+	protectedRemovals := 0
+	placementErrors := 0
+	for _, stack := range stacks {
+		sp, err := engine.GetStackPlan(context.Background(), swarm, stack, resolver)
 		if err != nil {
-			log.Fatal("Error updating networks when creating services", err)
+			return exitWithError(err)
 		}
+		printWarnings(color.Output, sp.Warnings)
 
-		sp := NewServicePrinter(ioutil.Discard, false)
-		for name, expectedService := range expected {
-			if _, found := targetMap[expectedService.Spec.Name]; len(targetMap) == 0 || found {
-				if currentService, found := current[name]; found {
-					if sp.PrintServiceSpecDiff(currentService.Spec, expectedService.Spec) {
-						cyan.Printf("Updating service %s\n", name)
-						_, servicesErr := swarm.ServiceUpdate(context.Background(), currentService.ID, currentService.Version, expectedService.Spec, types.ServiceUpdateOptions{})
-						if servicesErr != nil {
-							return cli.NewExitError(servicesErr.Error(), 3)
-						}
-					}
-				} else {
-					// service doesn't exist, need to create a new one
-					cyan.Printf("Creating service %s\n", name)
-					_, servicesErr := swarm.ServiceCreate(context.Background(), expectedService.Spec, types.ServiceCreateOptions{})
-					if servicesErr != nil {
-						return cli.NewExitError(servicesErr.Error(), 3)
-					}
-				}
-			}
+		stackChanges, protected, err := printPlan(sp, targetMap, allowDestroy, false)
+		if err != nil {
+			return exitWithError(err)
 		}
+		changes += stackChanges
+		protectedRemovals += protected
+		placementErrors += printPlacement(color.Output, engine.CheckPlacement(nodes, sp.Expected.Targets(targetMap)))
+		plans = append(plans, sp)
 	}
 
-	return nil
-}
-
-func updateNetworks(
-	ctx context.Context,
-	cli *client.Client,
-	networks []string,
-	namespace string,
-) error {
+	portConflicts := printPortConflicts(color.Output, engine.CheckPortConflicts(live, plans))
 
-	existingNetworks, err := stack.GetNetworks(ctx, cli, namespace)
-	if err != nil {
-		return err
+	if protectedRemovals > 0 {
+		return cli.NewExitError(fmt.Sprintf("Refusing to destroy %d protected service(s), use --allow-destroy to allow it", protectedRemovals), exitConflict)
 	}
 
-	existingNetworkMap := make(map[string]types.NetworkResource)
-	for _, network := range existingNetworks {
-		existingNetworkMap[network.Name] = network
+	if placementErrors > 0 {
+		return cli.NewExitError(fmt.Sprintf("Refusing to apply, %d service(s) can't be scheduled on any node", placementErrors), exitInvalid)
 	}
 
-	createOpts := types.NetworkCreate{
-		Labels: stack.GetStackLabels(namespace, nil),
-		Driver: "overlay",
-		IPAM:   &network.IPAM{Driver: "default"},
+	if portConflicts > 0 {
+		return cli.NewExitError(fmt.Sprintf("Refusing to apply, %d published port conflict(s) found", portConflicts), exitConflict)
 	}
 
-	for _, internalName := range networks {
-		name := fmt.Sprintf("%s_%s", namespace, internalName)
+	if changes == 0 {
+		fmt.Println("No changes to apply")
+		return nil
+	}
 
-		if _, exists := existingNetworkMap[name]; exists {
-			continue
+	if !autoApprove {
+		confirmed, err := askForConfirmation("Do you want to apply these changes?")
+		if err != nil {
+			return cli.NewExitError(err.Error()+", use --auto-approve to apply without confirmation", exitInvalid)
+		}
+		if !confirmed {
+			return cli.NewExitError("Apply cancelled", exitCancelled)
 		}
+	}
 
-		fmt.Printf("Creating network %s\n", name)
-		if _, err := cli.NetworkCreate(ctx, name, createOpts); err != nil {
-			return err
+	cyan := color.New(color.FgCyan)
+	opts := engine.ApplyOptions{
+		Targets:      targetMap,
+		AllowDestroy: allowDestroy,
+		RegistryAuth: registryAuth,
+		Progress: func(e engine.Event) {
+			message := fmt.Sprintf("%s %s %s\n", actionVerbs[e.Action], e.Kind, e.Name)
+			if e.Kind == "service" {
+				cyan.Print(message)
+			} else {
+				fmt.Print(message)
+			}
+		},
+		Warn: func(warning string) {
+			yellow.Printf("Warning: %s\n", warning)
+		},
+	}
+
+	for i, p := range plans {
+		if err := engine.ApplyPlan(context.Background(), swarm, p, opts); err != nil {
+			printPartialApply(plans[:i], err)
+			return exitWithError(err)
 		}
 	}
+
 	return nil
 }
 
-func getUniqueNetworkNames(services map[string]bundlefile.Service) []string {
-	networkSet := make(map[string]bool)
-	for _, service := range services {
-		for _, network := range service.Networks {
-			networkSet[network] = true
-		}
+// printPartialApply reports what was changed before the apply failed, the
+// stacks already applied and the changes made to the failed one, so the swarm
+// state can be reviewed before planning again.
+func printPartialApply(applied []*engine.StackPlan, err error) {
+	applyErr, ok := err.(*engine.ApplyError)
+	if !ok {
+		return
+	}
+
+	for _, p := range applied {
+		color.Red("Stack %s was applied\n", p.Stack.Name)
 	}
 
-	networks := []string{}
-	for network := range networkSet {
-		networks = append(networks, network)
+	if len(applyErr.Applied) == 0 {
+		color.Red("No changes were made to stack %s\n", applyErr.Stack)
+	} else {
+		color.Red("Stack %s was partially applied, %d change(s) made:\n", applyErr.Stack, len(applyErr.Applied))
 	}
-	return networks
+	for _, e := range applyErr.Applied {
+		color.Red("  %s %s %s\n", e.Action, e.Kind, e.Name)
+	}
+	if applyErr.Failed != nil {
+		color.Red("Failed to %s %s %s\n", applyErr.Failed.Action, applyErr.Failed.Kind, applyErr.Failed.Name)
+	}
+}
+
+var actionVerbs = map[string]string{
+	"create": "Creating",
+	"update": "Updating",
+	"remove": "Removing",
 }
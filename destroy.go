@@ -2,13 +2,13 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"strings"
 
 	"golang.org/x/net/context"
 
 	"github.com/docker/docker/client"
 	"github.com/fatih/color"
+	"github.com/mantika/whaleprint/engine"
 	"github.com/urfave/cli"
 )
 
@@ -18,40 +18,55 @@ func destroy(c *cli.Context) error {
 		return err
 	}
 
-	var services []string
-	for _, stack := range stacks {
-		for name, _ := range stack.Bundle.Services {
-			services = append(services, fmt.Sprintf("%s_%s", stack.Name, name))
-		}
-	}
-
 	force := c.Bool("force")
+	allowDestroy := getAllowDestroy(c)
 
 	swarm, swarmErr := client.NewEnvClient()
 	if swarmErr != nil {
-		return cli.NewExitError(swarmErr.Error(), 3)
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
+	}
+
+	if c.BoolT("lock") {
+		release, err := lockStacks(color.Output, swarm, stacks, c.Duration("lock-timeout"))
+		if err != nil {
+			return exitWithError(err)
+		}
+		defer release()
+	}
+
+	var services []string
+	for _, stack := range stacks {
+		names, err := engine.GetDestroyServices(context.Background(), swarm, stack, allowDestroy)
+		if err != nil {
+			return exitWithError(err)
+		}
+		services = append(services, names...)
 	}
 
 	if !force {
-		fmt.Printf("Are you sure you want to remove the following services? (%s) yes/no: ", strings.Join(services, ", "))
-		var input string
-		fmt.Scanln(&input)
-		switch {
-		case input == "no":
-			log.Fatal("Aborting")
-		case input == "yes":
-		default:
-			log.Fatalf("Incorrect option \"%s\", aborting", input)
+		confirmed, err := askForConfirmation(fmt.Sprintf("Are you sure you want to remove the following services? (%s)", strings.Join(services, ", ")))
+		if err != nil {
+			return cli.NewExitError(err.Error()+", use --force to destroy without confirmation", exitInvalid)
+		}
+		if !confirmed {
+			return cli.NewExitError("Destroy cancelled", exitCancelled)
 		}
 	}
 
+	// Keep removing the other services on failure, the ones left are reported
+	failed := 0
 	for _, service := range services {
 		color.Cyan("Removing service %s\n", service)
 		servicesErr := swarm.ServiceRemove(context.Background(), service)
 		if servicesErr != nil {
-			log.Println("Error removing service %s:, %s", service, err)
+			failed++
+			color.Red("Error removing service %s: %s\n", service, servicesErr)
 		}
 	}
 
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d service(s) couldn't be removed", failed, len(services)), exitAPI)
+	}
+
 	return nil
 }
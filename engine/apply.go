@@ -0,0 +1,294 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/client/stack"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"golang.org/x/net/context"
+)
+
+const maxUpdateRetries = 5
+
+var updateRetryBackoff = 500 * time.Millisecond
+
+// Event is a change about to be made to the swarm. Action is "create",
+// "update" or "remove" and Kind is "service", "network", "secret" or "config".
+type Event struct {
+	Action string
+	Kind   string
+	Name   string
+}
+
+// ApplyOptions customize how a plan is applied. Only target services are
+// processed, all of them if there are no targets. Progress is called before
+// every change and Warn with the problems which don't stop the apply, both
+// can be nil. Protected services are only removed when AllowDestroy has their
+// DAB or full name.
+type ApplyOptions struct {
+	Targets      map[string]bool
+	AllowDestroy map[string]bool
+	RegistryAuth *RegistryAuth
+	Progress     func(Event)
+	Warn         func(string)
+	state        *applyState
+}
+
+// applyState tracks the changes made while applying a plan
+type applyState struct {
+	applied []Event
+	pending *Event
+}
+
+// ApplyError is returned by ApplyPlan when the plan can't be fully applied.
+// Applied are the changes already made to the swarm and Failed the change
+// which failed, nil if the error didn't happen while making a change.
+type ApplyError struct {
+	Stack   string
+	Applied []Event
+	Failed  *Event
+	Err     error
+}
+
+func (e *ApplyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+func (o ApplyOptions) progress(action, kind, name string) {
+	e := Event{Action: action, Kind: kind, Name: name}
+	if o.state != nil {
+		o.state.pending = &e
+	}
+	if o.Progress != nil {
+		o.Progress(e)
+	}
+}
+
+// done records the last change reported as applied
+func (o ApplyOptions) done() {
+	if o.state != nil && o.state.pending != nil {
+		o.state.applied = append(o.state.applied, *o.state.pending)
+		o.state.pending = nil
+	}
+}
+
+func (o ApplyOptions) warn(format string, args ...interface{}) {
+	if o.Warn != nil {
+		o.Warn(fmt.Sprintf(format, args...))
+	}
+}
+
+func (o ApplyOptions) isTarget(name string) bool {
+	_, found := o.Targets[name]
+	return len(o.Targets) == 0 || found
+}
+
+// ApplyPlan makes the swarm match the plan: services which are no longer
+// expected are removed, then the stack networks, secrets and configs are
+// created and the services created or updated. Plans removing protected
+// services which aren't allowed to be destroyed are refused before making any
+// change. Failures are returned as an *ApplyError listing the changes already
+// made.
+func ApplyPlan(ctx context.Context, cli client.APIClient, p *StackPlan, opts ApplyOptions) error {
+	opts.state = &applyState{}
+	if err := applyPlan(ctx, cli, p, opts); err != nil {
+		return &ApplyError{Stack: p.Stack.Name, Applied: opts.state.applied, Failed: opts.state.pending, Err: err}
+	}
+	return nil
+}
+
+func applyPlan(ctx context.Context, cli client.APIClient, p *StackPlan, opts ApplyOptions) error {
+	expected := p.Expected
+	current := p.Current
+
+	for _, name := range current.Keys() {
+		cs := current[name]
+		if _, found := expected[name]; !found && opts.isTarget(cs.Spec.Name) && IsProtected(cs) && !isDestroyAllowed(opts.AllowDestroy, p.Stack.Name, name) {
+			return conflictErrorf("Refusing to destroy protected service %s, use --allow-destroy=%s to allow it", name, GetBundleServiceKey(name, p.Stack.Name))
+		}
+	}
+
+	for name, cs := range current {
+		if opts.isTarget(cs.Spec.Name) {
+			if _, found := expected[name]; !found {
+				// service exists but it's not expected, need to delete it
+				opts.progress("remove", "service", name)
+				if err := cli.ServiceRemove(ctx, name); err != nil {
+					return apiError(err)
+				}
+				opts.done()
+			}
+		}
+	}
+
+	if err := updateNetworks(ctx, cli, getUniqueNetworkNames(p.Stack.Bundle.Services), p.Stack.Name, opts); err != nil {
+		return wrapErrorf(APIError, err, "Error updating networks when creating services: %s", err)
+	}
+
+	if err := createSecrets(ctx, cli, p.Secrets, expected, opts); err != nil {
+		return err
+	}
+
+	if err := createConfigs(ctx, cli, p.Configs, expected, opts); err != nil {
+		return err
+	}
+
+	sp := NewServicePrinter(ioutil.Discard, false, nil)
+	for name, expectedService := range expected {
+		if !opts.isTarget(expectedService.Spec.Name) {
+			continue
+		}
+
+		encodedAuth := ""
+		if opts.RegistryAuth != nil {
+			var err error
+			encodedAuth, err = opts.RegistryAuth.EncodedAuth(expectedService.Spec.TaskTemplate.ContainerSpec.Image)
+			if err != nil {
+				return err
+			}
+		}
+
+		if currentService, found := current[name]; found {
+			different, err := sp.PrintServiceSpecDiff(currentService.Spec, expectedService.Spec)
+			if err != nil {
+				return err
+			}
+			if different {
+				opts.progress("update", "service", name)
+				retries, err := updateService(ctx, cli, currentService, expectedService.Spec, encodedAuth)
+				if retries > 0 {
+					opts.warn("service %s update was retried %d time(s) because of version conflicts", name, retries)
+				}
+				if err != nil {
+					return err
+				}
+				opts.done()
+			}
+		} else {
+			// service doesn't exist, need to create a new one
+			opts.progress("create", "service", name)
+			if _, err := cli.ServiceCreate(ctx, expectedService.Spec, types.ServiceCreateOptions{EncodedRegistryAuth: encodedAuth}); err != nil {
+				return apiError(err)
+			}
+			opts.done()
+		}
+	}
+
+	removeSecrets(ctx, cli, p.UnusedSecrets, opts)
+	removeConfigs(ctx, cli, p.UnusedConfigs, opts)
+
+	return nil
+}
+
+// updateService updates the planned service with the expected spec. If the
+// service version changed since it was planned the service is inspected again
+// and the update retried with backoff as long as the fresh spec is the same one
+// that was planned, so concurrent changes are never overwritten blindly.
+func updateService(ctx context.Context, cli client.APIClient, planned swarm.Service, expected swarm.ServiceSpec, encodedAuth string) (int, error) {
+	sp := NewServicePrinter(ioutil.Discard, false, nil)
+	version := planned.Version
+	backoff := updateRetryBackoff
+
+	for retries := 0; ; retries++ {
+		_, err := cli.ServiceUpdate(ctx, planned.ID, version, expected, types.ServiceUpdateOptions{EncodedRegistryAuth: encodedAuth})
+		if err == nil || !isVersionConflict(err) {
+			return retries, apiError(err)
+		}
+
+		if retries == maxUpdateRetries {
+			return retries, conflictErrorf("Error updating service %s after %d retries: %s", planned.Spec.Name, retries, err)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+
+		fresh, _, err := cli.ServiceInspectWithRaw(ctx, planned.ID, types.ServiceInspectOptions{})
+		if err != nil {
+			return retries + 1, apiError(err)
+		}
+
+		// Both are compared the way plan normalizes live services
+		modified, err := sp.PrintServiceSpecDiff(normalizeService(planned).Spec, normalizeService(fresh).Spec)
+		if err != nil {
+			return retries + 1, err
+		}
+		if modified {
+			return retries + 1, conflictErrorf("Service %s was modified by someone else since it was planned, run plan again", planned.Spec.Name)
+		}
+
+		version = fresh.Version
+	}
+}
+
+// isVersionConflict reports whether the daemon rejected the update because
+// the service version is stale. Swarm reports it as an "update out of
+// sequence" error, which the daemon doesn't send as a conflict.
+func isVersionConflict(err error) bool {
+	return errdefs.IsConflict(err) || strings.Contains(err.Error(), "update out of sequence")
+}
+
+func updateNetworks(
+	ctx context.Context,
+	cli client.APIClient,
+	networks []string,
+	namespace string,
+	opts ApplyOptions,
+) error {
+
+	existingNetworks, err := stack.GetNetworks(ctx, cli, namespace)
+	if err != nil {
+		return apiError(err)
+	}
+
+	existingNetworkMap := make(map[string]types.NetworkResource)
+	for _, network := range existingNetworks {
+		existingNetworkMap[network.Name] = network
+	}
+
+	createOpts := types.NetworkCreate{
+		Labels: stack.GetStackLabels(namespace, nil),
+		Driver: "overlay",
+		IPAM:   &network.IPAM{Driver: "default"},
+	}
+
+	for _, internalName := range networks {
+		name := fmt.Sprintf("%s_%s", namespace, internalName)
+
+		if _, exists := existingNetworkMap[name]; exists {
+			continue
+		}
+
+		opts.progress("create", "network", name)
+		if _, err := cli.NetworkCreate(ctx, name, createOpts); err != nil {
+			return apiError(err)
+		}
+		opts.done()
+	}
+	return nil
+}
+
+func getUniqueNetworkNames(services map[string]Service) []string {
+	networkSet := make(map[string]bool)
+	for _, service := range services {
+		for _, network := range service.Networks {
+			networkSet[network] = true
+		}
+	}
+
+	networks := []string{}
+	for network := range networkSet {
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+)
+
+// outOfSequence is the error the daemon returns for a stale service version
+var outOfSequence = errors.New("Error response from daemon: rpc error: code = Unknown desc = update out of sequence")
+
+// fakeSwarm stands in for the daemon, rejecting the updates of stale
+// versions. Only the calls made by updateService are implemented.
+type fakeSwarm struct {
+	client.APIClient
+	service  swarm.Service
+	versions []swarm.Version
+}
+
+func (f *fakeSwarm) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error) {
+	f.versions = append(f.versions, version)
+	if version.Index != f.service.Version.Index {
+		return types.ServiceUpdateResponse{}, outOfSequence
+	}
+	f.service.Spec = service
+	f.service.Version.Index++
+	return types.ServiceUpdateResponse{}, nil
+}
+
+func (f *fakeSwarm) ServiceInspectWithRaw(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+	return f.service, nil, nil
+}
+
+func newFakeSwarm() (*fakeSwarm, swarm.Service) {
+	live := swarm.Service{ID: "s1"}
+	live.Version.Index = 11
+	live.Spec.Name = "vote_web"
+	live.Spec.TaskTemplate.ContainerSpec.Image = "vote/web:1.0"
+	// Newer daemons report the networks in the task template
+	live.Spec.TaskTemplate.Networks = []swarm.NetworkAttachmentConfig{{Target: "net1", Aliases: []string{"front", "web"}}}
+
+	// The service was planned at an older version with the same spec
+	planned := GetSwarmServicesSpecForStack([]swarm.Service{live})["vote_web"]
+	planned.Version.Index = 10
+	return &fakeSwarm{service: live}, planned
+}
+
+func TestUpdateServiceRetriesStaleVersion(t *testing.T) {
+	updateRetryBackoff = 0
+	f, planned := newFakeSwarm()
+
+	expected := planned.Spec
+	expected.TaskTemplate.ContainerSpec.Image = "vote/web:2.0"
+	retries, err := updateService(context.Background(), f, planned, expected, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retries != 1 {
+		t.Errorf("got %d retries, want 1", retries)
+	}
+	if got := f.service.Spec.TaskTemplate.ContainerSpec.Image; got != "vote/web:2.0" {
+		t.Errorf("image = %q, want vote/web:2.0", got)
+	}
+	if len(f.versions) != 2 || f.versions[1].Index != 11 {
+		t.Errorf("updates sent with versions %v, want 10 then 11", f.versions)
+	}
+}
+
+func TestUpdateServiceModifiedConcurrently(t *testing.T) {
+	updateRetryBackoff = 0
+	f, planned := newFakeSwarm()
+	f.service.Spec.TaskTemplate.ContainerSpec.Image = "vote/web:1.1"
+
+	expected := planned.Spec
+	expected.TaskTemplate.ContainerSpec.Image = "vote/web:2.0"
+	_, err := updateService(context.Background(), f, planned, expected, "")
+	if KindOf(err) != ConflictError {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+	if got := f.service.Spec.TaskTemplate.ContainerSpec.Image; got != "vote/web:1.1" {
+		t.Errorf("concurrent change was overwritten with %q", got)
+	}
+}
+
+func TestApplyPlanRefusesProtectedRemoval(t *testing.T) {
+	f, planned := newFakeSwarm()
+	planned.Spec.Labels = map[string]string{protectLabel: "true"}
+	p := &StackPlan{
+		Stack:    Stack{Name: "vote", Bundle: &Bundlefile{Services: map[string]Service{}}},
+		Current:  Services{"vote_web": planned},
+		Expected: Services{},
+	}
+
+	// The fake panics on ServiceRemove, nothing must be changed
+	err := ApplyPlan(context.Background(), f, p, ApplyOptions{})
+	if KindOf(err) != ConflictError {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+	if applyErr, ok := err.(*ApplyError); !ok || len(applyErr.Applied) > 0 || applyErr.Failed != nil {
+		t.Errorf("got %#v, want no change made", err)
+	}
+}
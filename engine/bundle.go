@@ -0,0 +1,535 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/client/bundlefile"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/go-connections/nat"
+)
+
+const protectLabel = "whaleprint.protect"
+
+// Bundlefile is a DAB extended with whaleprint specific properties. It's
+// backwards compatible with docker's bundlefile format.
+type Bundlefile struct {
+	Version  string
+	Services map[string]Service
+	Secrets  map[string]Secret `json:",omitempty"`
+	Configs  map[string]Config `json:",omitempty"`
+	// Logging is the default logging configuration of the stack services
+	Logging *Logging `json:",omitempty"`
+	// Outputs are templates of values computed from the live stack
+	Outputs map[string]string `json:",omitempty"`
+}
+
+// Service is a DAB service plus whaleprint extensions. Resources, Mounts,
+// RestartPolicy, UpdateConfig and RollbackConfig use the swarm API format.
+type Service struct {
+	bundlefile.Service
+	Name           string                      `json:",omitempty"`
+	Lifecycle      *Lifecycle                  `json:",omitempty"`
+	Secrets        []SecretReference           `json:",omitempty"`
+	Configs        []ConfigReference           `json:",omitempty"`
+	Healthcheck    *Healthcheck                `json:",omitempty"`
+	Logging        *Logging                    `json:",omitempty"`
+	Placement      *Placement                  `json:",omitempty"`
+	Ports          Ports                       `json:",omitempty"`
+	Resources      *swarm.ResourceRequirements `json:",omitempty"`
+	Mounts         []mount.Mount               `json:",omitempty"`
+	RestartPolicy  *swarm.RestartPolicy        `json:",omitempty"`
+	UpdateConfig   *swarm.UpdateConfig         `json:",omitempty"`
+	RollbackConfig *swarm.UpdateConfig         `json:",omitempty"`
+}
+
+// GetServiceName returns the swarm name of the bundle service, which is
+// "<stack>_<name>" unless the service sets its own Name
+func GetServiceName(stackName, name string, service Service) string {
+	if service.Name != "" {
+		return service.Name
+	}
+	return fmt.Sprintf("%s_%s", stackName, name)
+}
+
+// Lifecycle customizes how whaleprint handles the service lifecycle
+type Lifecycle struct {
+	PreventDestroy bool `json:",omitempty"`
+}
+
+// Secret is a swarm secret whose content comes from a local file or an
+// environment variable. External secrets are expected to exist already and
+// are not managed by whaleprint.
+type Secret struct {
+	File        string `json:",omitempty"`
+	Environment string `json:",omitempty"`
+	External    bool   `json:",omitempty"`
+	// Name of the external secret, defaults to the secret key
+	Name string `json:",omitempty"`
+}
+
+// SecretReference attaches a secret to a service. Mode is an octal string
+// like "0440".
+type SecretReference struct {
+	Source string
+	Target string `json:",omitempty"`
+	UID    string `json:",omitempty"`
+	GID    string `json:",omitempty"`
+	Mode   string `json:",omitempty"`
+}
+
+// Config is a swarm config whose content comes from a local file. When
+// Template is set ${VAR} references in the content are replaced with the
+// values of the environment variables.
+type Config struct {
+	File     string `json:",omitempty"`
+	Template bool   `json:",omitempty"`
+	External bool   `json:",omitempty"`
+	// Name of the external config, defaults to the config key
+	Name string `json:",omitempty"`
+}
+
+// ConfigReference mounts a config in a service. Mode is an octal string
+// like "0440".
+type ConfigReference struct {
+	Source string
+	Target string `json:",omitempty"`
+	UID    string `json:",omitempty"`
+	GID    string `json:",omitempty"`
+	Mode   string `json:",omitempty"`
+}
+
+// Healthcheck overrides the image HEALTHCHECK. Durations are expressed as
+// strings like "30s". A single Test command is run with the shell.
+type Healthcheck struct {
+	Test        []string `json:",omitempty"`
+	Interval    string   `json:",omitempty"`
+	Timeout     string   `json:",omitempty"`
+	StartPeriod string   `json:",omitempty"`
+	Retries     int      `json:",omitempty"`
+	Disable     bool     `json:",omitempty"`
+}
+
+// Logging configures the log driver of a service
+type Logging struct {
+	Driver  string
+	Options map[string]string `json:",omitempty" yaml:",omitempty"`
+}
+
+// builtinLogDrivers are the log drivers shipped with docker, any other driver
+// must be installed as a plugin
+var builtinLogDrivers = map[string]bool{
+	"awslogs":    true,
+	"etwlogs":    true,
+	"fluentd":    true,
+	"gcplogs":    true,
+	"gelf":       true,
+	"journald":   true,
+	"json-file":  true,
+	"local":      true,
+	"logentries": true,
+	"none":       true,
+	"splunk":     true,
+	"syslog":     true,
+}
+
+// Placement holds the scheduling properties which complement the service
+// Constraints
+type Placement struct {
+	Preferences []PlacementPreference `json:",omitempty"`
+	Platforms   []swarm.Platform      `json:",omitempty"`
+	MaxReplicas uint64                `json:",omitempty"`
+}
+
+// PlacementPreference spreads tasks evenly over the values of a node label
+// like "node.labels.datacenter"
+type PlacementPreference struct {
+	Spread string
+}
+
+// Port is a DAB port extended with the publish mode, which can be "ingress"
+// (default) or "host"
+type Port struct {
+	Protocol      string
+	Port          uint32
+	PublishedPort uint32 `json:",omitempty"`
+	Mode          string `json:",omitempty"`
+}
+
+// Ports can be written as Port objects or as strings with the docker syntax
+// "[published:]target[/protocol]", ranges like "8000-8010:8000-8010/udp"
+// included. String ports are always published through the ingress.
+type Ports []Port
+
+func (p *Ports) UnmarshalJSON(data []byte) error {
+	raw := []json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	ports := Ports{}
+	for _, r := range raw {
+		var spec string
+		if err := json.Unmarshal(r, &spec); err == nil {
+			parsed, err := parsePortSpec(spec)
+			if err != nil {
+				return err
+			}
+			ports = append(ports, parsed...)
+			continue
+		}
+
+		port := Port{}
+		if err := json.Unmarshal(r, &port); err != nil {
+			return err
+		}
+		if port.Mode != "" && port.Mode != string(swarm.PortConfigPublishModeIngress) && port.Mode != string(swarm.PortConfigPublishModeHost) {
+			return validationErrorf("Invalid port mode \"%s\", only \"ingress\" or \"host\" are allowed", port.Mode)
+		}
+		ports = append(ports, port)
+	}
+
+	*p = ports
+	return nil
+}
+
+func parsePortSpec(spec string) (Ports, error) {
+	mappings, err := nat.ParsePortSpec(spec)
+	if err != nil {
+		return nil, validationErrorf("Invalid port \"%s\": %s", spec, err)
+	}
+
+	ports := Ports{}
+	for _, mapping := range mappings {
+		if mapping.Binding.HostIP != "" {
+			return nil, validationErrorf("Invalid port \"%s\": swarm services can't bind to an IP", spec)
+		}
+
+		port := Port{Protocol: mapping.Port.Proto(), Port: uint32(mapping.Port.Int())}
+		if mapping.Binding.HostPort != "" {
+			published, err := strconv.ParseUint(mapping.Binding.HostPort, 10, 16)
+			if err != nil {
+				return nil, validationErrorf("Invalid port \"%s\": %s", spec, err)
+			}
+			port.PublishedPort = uint32(published)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func convertPorts(ports Ports) []swarm.PortConfig {
+	configs := []swarm.PortConfig{}
+	for _, port := range ports {
+		protocol := swarm.PortConfigProtocol(port.Protocol)
+		if protocol == "" {
+			protocol = swarm.PortConfigProtocolTCP
+		}
+
+		mode := swarm.PortConfigPublishMode(port.Mode)
+		if mode == "" {
+			mode = swarm.PortConfigPublishModeIngress
+		}
+
+		configs = append(configs, swarm.PortConfig{
+			TargetPort:    port.Port,
+			Protocol:      protocol,
+			PublishedPort: port.PublishedPort,
+			PublishMode:   mode,
+		})
+	}
+	return configs
+}
+
+func getBundlePorts(configs []swarm.PortConfig) Ports {
+	ports := Ports{}
+	for _, config := range configs {
+		port := Port{
+			Protocol:      string(config.Protocol),
+			Port:          config.TargetPort,
+			PublishedPort: config.PublishedPort,
+		}
+		if config.PublishMode == swarm.PortConfigPublishModeHost {
+			port.Mode = string(config.PublishMode)
+		}
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func (s Service) preventDestroy() bool {
+	return s.Lifecycle != nil && s.Lifecycle.PreventDestroy
+}
+
+// LoadBundlefile decodes a DAB. The NAME=${NAME} placeholders of its
+// environment are only replaced when the stack is planned.
+func LoadBundlefile(reader io.Reader) (*Bundlefile, error) {
+	return decodeBundlefile(reader)
+}
+
+func decodeBundlefile(reader io.Reader) (*Bundlefile, error) {
+	bundle := &Bundlefile{}
+
+	if err := json.NewDecoder(reader).Decode(bundle); err != nil {
+		switch jsonErr := err.(type) {
+		case *json.SyntaxError:
+			return nil, loadErrorf("JSON syntax error at byte %v: %s", jsonErr.Offset, jsonErr.Error())
+		case *json.UnmarshalTypeError:
+			return nil, validationErrorf("Unexpected type at byte %v. Expected %s but received %s.", jsonErr.Offset, jsonErr.Type, jsonErr.Value)
+		}
+		// Invalid values like port specs are bundle errors, not read errors
+		if KindOf(err) == ValidationError {
+			return nil, validationErrorf("Invalid DAB file: %s", err)
+		}
+		return nil, loadErrorf("Error reading DAB file: %s", err)
+	}
+
+	return bundle, nil
+}
+
+// ReadBundlefile reads the DAB in path without interpolating its environment
+// variables, returning an empty bundle if it doesn't exist
+func ReadBundlefile(path string) (*Bundlefile, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &Bundlefile{Version: "0.1", Services: map[string]Service{}}, nil
+	} else if err != nil {
+		return nil, loadError(err)
+	}
+	defer file.Close()
+
+	bundle, err := decodeBundlefile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Services == nil {
+		bundle.Services = map[string]Service{}
+	}
+	return bundle, nil
+}
+
+// GetBundleServiceKey returns the name of the service in the stack DAB
+func GetBundleServiceKey(serviceName, stackName string) string {
+	return strings.TrimPrefix(serviceName, stackName+"_")
+}
+
+// Keys returns the sorted names of the bundle services
+func (b *Bundlefile) Keys() []string {
+	return SortedKeys(b.Services)
+}
+
+// PrintBundlefile writes the bundle as indented JSON, the same way
+// bundlefile.Print does
+func PrintBundlefile(out io.Writer, bundle *Bundlefile) error {
+	bytes, err := json.MarshalIndent(*bundle, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(append(bytes, '\n'))
+	return err
+}
+
+// WriteBundlefile writes the bundle to file, which is only overwritten if
+// force is set
+func WriteBundlefile(file string, bundle *Bundlefile, force bool) error {
+	return writeFile(file, force, func(w io.Writer) error {
+		return PrintBundlefile(w, bundle)
+	})
+}
+
+// CheckOverwrite returns a conflict error for the first of the files which
+// already exists unless force is set, so every destination can be checked
+// before any file is written
+func CheckOverwrite(files []string, force bool) error {
+	if force {
+		return nil
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			return conflictErrorf("File %s already exists, use --force to overwrite it", file)
+		}
+	}
+	return nil
+}
+
+// writeFile creates file with the output of print, reporting the errors of
+// closing it since they may mean the content wasn't written
+func writeFile(file string, force bool, print func(io.Writer) error) error {
+	if err := CheckOverwrite([]string{file}, force); err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return loadError(err)
+	}
+	if err := print(f); err != nil {
+		f.Close()
+		return loadError(err)
+	}
+	return loadError(f.Close())
+}
+
+// readSource reads content from a file, relative to the DAB file, or from an
+// environment variable.
+func readSource(stack Stack, file, env string) ([]byte, error) {
+	switch {
+	case file != "" && env != "":
+		return nil, fmt.Errorf("Only one of File or Environment can be set")
+	case file != "":
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(stack.File), file)
+		}
+		return ioutil.ReadFile(file)
+	case env != "":
+		value, found := os.LookupEnv(env)
+		if !found {
+			return nil, fmt.Errorf("Environment variable %s is not set", env)
+		}
+		return []byte(value), nil
+	default:
+		return nil, fmt.Errorf("Either File or Environment must be set")
+	}
+}
+
+func convertHealthcheck(healthcheck *Healthcheck) (*container.HealthConfig, error) {
+	if healthcheck == nil {
+		return nil, nil
+	}
+
+	if healthcheck.Disable {
+		if len(healthcheck.Test) > 0 {
+			return nil, fmt.Errorf("Test and Disable can't be set at the same time")
+		}
+		return &container.HealthConfig{Test: []string{"NONE"}}, nil
+	}
+
+	config := &container.HealthConfig{Test: healthcheck.Test, Retries: healthcheck.Retries}
+	if len(config.Test) == 1 && config.Test[0] != "NONE" {
+		config.Test = []string{"CMD-SHELL", config.Test[0]}
+	}
+
+	durations := []struct {
+		value string
+		field *time.Duration
+	}{
+		{healthcheck.Interval, &config.Interval},
+		{healthcheck.Timeout, &config.Timeout},
+		{healthcheck.StartPeriod, &config.StartPeriod},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid healthcheck duration \"%s\"", d.value)
+		}
+		*d.field = duration
+	}
+
+	return config, nil
+}
+
+func getBundleHealthcheck(config *container.HealthConfig) *Healthcheck {
+	if config == nil {
+		return nil
+	}
+
+	if len(config.Test) == 1 && config.Test[0] == "NONE" {
+		return &Healthcheck{Disable: true}
+	}
+
+	healthcheck := &Healthcheck{Test: config.Test, Retries: config.Retries}
+	if config.Interval != 0 {
+		healthcheck.Interval = config.Interval.String()
+	}
+	if config.Timeout != 0 {
+		healthcheck.Timeout = config.Timeout.String()
+	}
+	if config.StartPeriod != 0 {
+		healthcheck.StartPeriod = config.StartPeriod.String()
+	}
+	return healthcheck
+}
+
+// convertLogging returns the log driver of a service, which inherits the stack
+// default when it doesn't set its own
+func convertLogging(stackDefault, logging *Logging) (*swarm.Driver, error) {
+	if logging == nil {
+		logging = stackDefault
+	}
+	if logging == nil {
+		return nil, nil
+	}
+
+	if logging.Driver == "" {
+		return nil, fmt.Errorf("Driver must be set")
+	}
+
+	return &swarm.Driver{Name: logging.Driver, Options: logging.Options}, nil
+}
+
+// checkLogDrivers returns a warning for every service using a log driver which
+// isn't built in, it only works if the plugin is installed on every node
+func checkLogDrivers(stack Stack) []string {
+	warnings := []string{}
+	for _, name := range stack.Bundle.Keys() {
+		service := stack.Bundle.Services[name]
+		logging := service.Logging
+		if logging == nil {
+			logging = stack.Bundle.Logging
+		}
+		if logging != nil && logging.Driver != "" && !builtinLogDrivers[logging.Driver] {
+			warnings = append(warnings, fmt.Sprintf("service %s uses log driver \"%s\" which isn't built in, it must be installed as a plugin on every node", GetServiceName(stack.Name, name, service), logging.Driver))
+		}
+	}
+	return warnings
+}
+
+func getBundleLogging(driver *swarm.Driver) *Logging {
+	if driver == nil {
+		return nil
+	}
+	return &Logging{Driver: driver.Name, Options: driver.Options}
+}
+
+func convertPlacement(constraints []string, placement *Placement) *swarm.Placement {
+	p := &swarm.Placement{Constraints: constraints}
+	if placement == nil {
+		return p
+	}
+
+	for _, pref := range placement.Preferences {
+		p.Preferences = append(p.Preferences, swarm.PlacementPreference{
+			Spread: &swarm.SpreadOver{SpreadDescriptor: pref.Spread},
+		})
+	}
+	p.Platforms = placement.Platforms
+	p.MaxReplicas = placement.MaxReplicas
+	return p
+}
+
+func getBundlePlacement(placement *swarm.Placement) *Placement {
+	if placement == nil || (len(placement.Preferences) == 0 && len(placement.Platforms) == 0 && placement.MaxReplicas == 0) {
+		return nil
+	}
+
+	p := &Placement{Platforms: placement.Platforms, MaxReplicas: placement.MaxReplicas}
+	for _, pref := range placement.Preferences {
+		if pref.Spread != nil {
+			p.Preferences = append(p.Preferences, PlacementPreference{Spread: pref.Spread.SpreadDescriptor})
+		}
+	}
+	return p
+}
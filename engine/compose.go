@@ -0,0 +1,406 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"gopkg.in/yaml.v2"
+)
+
+// ComposeVersion is the compose file format version services are exported to
+const ComposeVersion = "3.8"
+
+// ComposeFile is the subset of the compose v3 format whaleprint can export
+// live services to
+type ComposeFile struct {
+	Version  string                     `yaml:"version"`
+	Services map[string]ComposeService  `yaml:"services"`
+	Networks map[string]ComposeExternal `yaml:"networks,omitempty"`
+	Secrets  map[string]ComposeExternal `yaml:"secrets,omitempty"`
+	Configs  map[string]ComposeExternal `yaml:"configs,omitempty"`
+}
+
+// ComposeExternal is a top level network, secret or config definition
+type ComposeExternal struct {
+	External bool   `yaml:"external,omitempty"`
+	Name     string `yaml:"name,omitempty"`
+}
+
+// ComposeService is a compose service definition, the swarm properties go
+// under deploy
+type ComposeService struct {
+	Image           string              `yaml:"image"`
+	Entrypoint      []string            `yaml:"entrypoint,omitempty"`
+	Command         []string            `yaml:"command,omitempty"`
+	Environment     []string            `yaml:"environment,omitempty"`
+	WorkingDir      string              `yaml:"working_dir,omitempty"`
+	User            string              `yaml:"user,omitempty"`
+	Hostname        string              `yaml:"hostname,omitempty"`
+	TTY             bool                `yaml:"tty,omitempty"`
+	ReadOnly        bool                `yaml:"read_only,omitempty"`
+	StopGracePeriod string              `yaml:"stop_grace_period,omitempty"`
+	Labels          map[string]string   `yaml:"labels,omitempty"`
+	Healthcheck     *ComposeHealthcheck `yaml:"healthcheck,omitempty"`
+	Logging         *Logging            `yaml:"logging,omitempty"`
+	Ports           []ComposePort       `yaml:"ports,omitempty"`
+	Networks        []string            `yaml:"networks,omitempty"`
+	Secrets         []ComposeFileRef    `yaml:"secrets,omitempty"`
+	Configs         []ComposeFileRef    `yaml:"configs,omitempty"`
+	Deploy          ComposeDeploy       `yaml:"deploy"`
+}
+
+// ComposeHealthcheck overrides the image healthcheck, durations use the Go
+// format
+type ComposeHealthcheck struct {
+	Test        []string `yaml:"test,omitempty"`
+	Interval    string   `yaml:"interval,omitempty"`
+	Timeout     string   `yaml:"timeout,omitempty"`
+	StartPeriod string   `yaml:"start_period,omitempty"`
+	Retries     int      `yaml:"retries,omitempty"`
+	Disable     bool     `yaml:"disable,omitempty"`
+}
+
+// ComposePort is a port in the compose long syntax
+type ComposePort struct {
+	Target    uint32 `yaml:"target"`
+	Published uint32 `yaml:"published,omitempty"`
+	Protocol  string `yaml:"protocol,omitempty"`
+	Mode      string `yaml:"mode,omitempty"`
+}
+
+// ComposeFileRef mounts a secret or config in the service containers. Mode
+// is written as a number since compose doesn't read it from a string.
+type ComposeFileRef struct {
+	Source string  `yaml:"source"`
+	Target string  `yaml:"target,omitempty"`
+	UID    string  `yaml:"uid,omitempty"`
+	GID    string  `yaml:"gid,omitempty"`
+	Mode   *uint32 `yaml:"mode,omitempty"`
+}
+
+// ComposeDeploy holds the swarm properties of a compose service
+type ComposeDeploy struct {
+	Mode          string                `yaml:"mode,omitempty"`
+	Replicas      *uint64               `yaml:"replicas,omitempty"`
+	EndpointMode  string                `yaml:"endpoint_mode,omitempty"`
+	Labels        map[string]string     `yaml:"labels,omitempty"`
+	Placement     *ComposePlacement     `yaml:"placement,omitempty"`
+	Resources     *ComposeResources     `yaml:"resources,omitempty"`
+	RestartPolicy *ComposeRestartPolicy `yaml:"restart_policy,omitempty"`
+	UpdateConfig  *ComposeUpdateConfig  `yaml:"update_config,omitempty"`
+	Rollback      *ComposeUpdateConfig  `yaml:"rollback_config,omitempty"`
+}
+
+// ComposePlacement constrains the nodes the service tasks are scheduled on
+type ComposePlacement struct {
+	Constraints []string              `yaml:"constraints,omitempty"`
+	Preferences []PlacementPreference `yaml:"preferences,omitempty"`
+	MaxReplicas uint64                `yaml:"max_replicas_per_node,omitempty"`
+}
+
+// ComposeResources are the resource limits and reservations of the service
+// tasks
+type ComposeResources struct {
+	Limits       *ComposeResource `yaml:"limits,omitempty"`
+	Reservations *ComposeResource `yaml:"reservations,omitempty"`
+}
+
+// ComposeResource is an amount of CPUs and memory, like "0.5" and "268435456b"
+type ComposeResource struct {
+	CPUs   string `yaml:"cpus,omitempty"`
+	Memory string `yaml:"memory,omitempty"`
+}
+
+// ComposeRestartPolicy tells swarm when to restart the service tasks
+type ComposeRestartPolicy struct {
+	Condition   string  `yaml:"condition,omitempty"`
+	Delay       string  `yaml:"delay,omitempty"`
+	MaxAttempts *uint64 `yaml:"max_attempts,omitempty"`
+	Window      string  `yaml:"window,omitempty"`
+}
+
+// ComposeUpdateConfig is how the service tasks are updated or rolled back
+type ComposeUpdateConfig struct {
+	Parallelism     *uint64 `yaml:"parallelism,omitempty"`
+	Delay           string  `yaml:"delay,omitempty"`
+	FailureAction   string  `yaml:"failure_action,omitempty"`
+	Monitor         string  `yaml:"monitor,omitempty"`
+	MaxFailureRatio float32 `yaml:"max_failure_ratio,omitempty"`
+	Order           string  `yaml:"order,omitempty"`
+}
+
+// PrintComposeFile writes the compose file as YAML
+func PrintComposeFile(out io.Writer, compose *ComposeFile) error {
+	data, err := yaml.Marshal(compose)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// WriteComposeFile writes the compose file to file, which is only overwritten
+// if force is set
+func WriteComposeFile(file string, compose *ComposeFile, force bool) error {
+	return writeFile(file, force, func(w io.Writer) error {
+		return PrintComposeFile(w, compose)
+	})
+}
+
+// Keys returns the sorted service names of the compose file
+func (c *ComposeFile) Keys() []string {
+	return SortedKeys(c.Services)
+}
+
+// GetComposeService returns the compose definition of the service, adding the
+// networks, secrets and configs it uses to the compose file. It also returns
+// a warning for every property which can't be represented in compose.
+func (e *Exporter) GetComposeService(service swarm.Service, stackName string, compose *ComposeFile) (*ComposeService, []string) {
+	spec := service.Spec
+	task := spec.TaskTemplate
+	containerSpec := task.ContainerSpec
+	warnings := []string{}
+
+	composeService := &ComposeService{
+		Image:       containerSpec.Image,
+		Entrypoint:  containerSpec.Command,
+		Command:     containerSpec.Args,
+		Environment: containerSpec.Env,
+		WorkingDir:  containerSpec.Dir,
+		User:        containerSpec.User,
+		Hostname:    containerSpec.Hostname,
+		TTY:         containerSpec.TTY,
+		ReadOnly:    containerSpec.ReadOnly,
+		Labels:      withoutLabels(containerSpec.Labels, "com.docker.stack.namespace"),
+		Logging:     getBundleLogging(task.LogDriver),
+		Deploy: ComposeDeploy{
+			Labels: withoutLabels(spec.Labels, "com.docker.stack.namespace", protectLabel),
+		},
+	}
+
+	if containerSpec.StopGracePeriod != nil {
+		composeService.StopGracePeriod = containerSpec.StopGracePeriod.String()
+	}
+
+	if hc := containerSpec.Healthcheck; hc != nil {
+		if len(hc.Test) == 1 && hc.Test[0] == "NONE" {
+			composeService.Healthcheck = &ComposeHealthcheck{Disable: true}
+		} else {
+			composeService.Healthcheck = &ComposeHealthcheck{
+				Test:        hc.Test,
+				Interval:    composeDuration(&hc.Interval),
+				Timeout:     composeDuration(&hc.Timeout),
+				StartPeriod: composeDuration(&hc.StartPeriod),
+				Retries:     hc.Retries,
+			}
+		}
+	}
+
+	if spec.Mode.Global != nil {
+		composeService.Deploy.Mode = "global"
+	} else if spec.Mode.Replicated != nil {
+		composeService.Deploy.Replicas = spec.Mode.Replicated.Replicas
+	} else {
+		warnings = append(warnings, "service mode")
+	}
+
+	if spec.EndpointSpec != nil {
+		if spec.EndpointSpec.Mode == swarm.ResolutionModeDNSRR {
+			composeService.Deploy.EndpointMode = string(spec.EndpointSpec.Mode)
+		}
+		for _, port := range spec.EndpointSpec.Ports {
+			if port.Name != "" {
+				warnings = append(warnings, fmt.Sprintf("name of port %d", port.TargetPort))
+			}
+			composePort := ComposePort{
+				Target:    port.TargetPort,
+				Published: port.PublishedPort,
+				Protocol:  string(port.Protocol),
+			}
+			if port.PublishMode == swarm.PortConfigPublishModeHost {
+				composePort.Mode = string(port.PublishMode)
+			}
+			composeService.Ports = append(composeService.Ports, composePort)
+		}
+	}
+
+	if placement := task.Placement; placement != nil {
+		p := &ComposePlacement{
+			Constraints: placement.Constraints,
+			MaxReplicas: placement.MaxReplicas,
+		}
+		for _, pref := range placement.Preferences {
+			if pref.Spread != nil {
+				p.Preferences = append(p.Preferences, PlacementPreference{Spread: pref.Spread.SpreadDescriptor})
+			}
+		}
+		if len(p.Constraints) > 0 || len(p.Preferences) > 0 || p.MaxReplicas > 0 {
+			composeService.Deploy.Placement = p
+		}
+		if len(placement.Platforms) > 0 {
+			warnings = append(warnings, "placement platforms")
+		}
+	}
+
+	if resources := task.Resources; resources != nil {
+		r := &ComposeResources{}
+		if limits := resources.Limits; limits != nil {
+			if limits.NanoCPUs > 0 || limits.MemoryBytes > 0 {
+				r.Limits = &ComposeResource{CPUs: composeCPUs(limits.NanoCPUs), Memory: composeMemory(limits.MemoryBytes)}
+			}
+			if limits.Pids > 0 {
+				warnings = append(warnings, "pids limit")
+			}
+		}
+		if reservations := resources.Reservations; reservations != nil {
+			if reservations.NanoCPUs > 0 || reservations.MemoryBytes > 0 {
+				r.Reservations = &ComposeResource{CPUs: composeCPUs(reservations.NanoCPUs), Memory: composeMemory(reservations.MemoryBytes)}
+			}
+			if len(reservations.GenericResources) > 0 {
+				warnings = append(warnings, "generic resources")
+			}
+		}
+		if r.Limits != nil || r.Reservations != nil {
+			composeService.Deploy.Resources = r
+		}
+	}
+
+	if restart := task.RestartPolicy; restart != nil {
+		composeService.Deploy.RestartPolicy = &ComposeRestartPolicy{
+			Condition:   string(restart.Condition),
+			Delay:       composeDuration(restart.Delay),
+			MaxAttempts: restart.MaxAttempts,
+			Window:      composeDuration(restart.Window),
+		}
+	}
+
+	composeService.Deploy.UpdateConfig = getComposeUpdateConfig(spec.UpdateConfig)
+	composeService.Deploy.Rollback = getComposeUpdateConfig(spec.RollbackConfig)
+
+	networks := spec.Networks
+	if len(networks) == 0 {
+		networks = task.Networks
+	}
+	for _, net := range networks {
+		name := e.NetworkName(net.Target)
+
+		// Stack networks are created by the stack, others must exist already
+		key := strings.TrimPrefix(name, stackName+"_")
+
+		// Only aliases other than the ones compose or whaleprint set are lost
+		serviceKey := GetBundleServiceKey(spec.Name, stackName)
+		defaultAliases := len(net.Aliases) == 0 || isDefaultAliases(net.Aliases, key, serviceKey) ||
+			(len(net.Aliases) == 1 && net.Aliases[0] == serviceKey)
+		if !defaultAliases {
+			warnings = append(warnings, fmt.Sprintf("aliases of network %s", name))
+		}
+		if compose.Networks == nil {
+			compose.Networks = map[string]ComposeExternal{}
+		}
+		if key == name {
+			compose.Networks[key] = ComposeExternal{External: true, Name: name}
+		} else {
+			compose.Networks[key] = ComposeExternal{}
+		}
+		composeService.Networks = append(composeService.Networks, key)
+	}
+
+	for _, ref := range containerSpec.Secrets {
+		name := ref.SecretName
+		if secret, found := e.secrets[ref.SecretID]; found && secret.Spec.Labels[secretLabel] != "" {
+			name = secret.Spec.Labels[secretLabel]
+		}
+		if compose.Secrets == nil {
+			compose.Secrets = map[string]ComposeExternal{}
+		}
+		compose.Secrets[name] = ComposeExternal{External: true, Name: ref.SecretName}
+		composeService.Secrets = append(composeService.Secrets, getComposeFileRef(name, ref.File))
+	}
+
+	for _, ref := range containerSpec.Configs {
+		name := ref.ConfigName
+		if config, found := e.configs[ref.ConfigID]; found && config.Spec.Labels[configLabel] != "" {
+			name = config.Spec.Labels[configLabel]
+		}
+		if compose.Configs == nil {
+			compose.Configs = map[string]ComposeExternal{}
+		}
+		compose.Configs[name] = ComposeExternal{External: true, Name: ref.ConfigName}
+
+		var file *swarm.SecretReferenceFileTarget
+		if ref.File != nil {
+			f := swarm.SecretReferenceFileTarget(*ref.File)
+			file = &f
+		}
+		composeService.Configs = append(composeService.Configs, getComposeFileRef(name, file))
+	}
+
+	if len(containerSpec.Mounts) > 0 {
+		warnings = append(warnings, "mounts")
+	}
+	if len(containerSpec.Hosts) > 0 {
+		warnings = append(warnings, "extra hosts")
+	}
+	if containerSpec.DNSConfig != nil {
+		warnings = append(warnings, "DNS config")
+	}
+	if containerSpec.Privileges != nil {
+		warnings = append(warnings, "privileges")
+	}
+	if IsProtected(service) {
+		warnings = append(warnings, "protection from destroy")
+	}
+
+	return composeService, warnings
+}
+
+func getComposeFileRef(name string, file *swarm.SecretReferenceFileTarget) ComposeFileRef {
+	ref := ComposeFileRef{Source: name}
+	if file != nil {
+		ref.Target = file.Name
+		ref.UID = file.UID
+		ref.GID = file.GID
+		mode := uint32(file.Mode)
+		ref.Mode = &mode
+	}
+	return ref
+}
+
+func getComposeUpdateConfig(config *swarm.UpdateConfig) *ComposeUpdateConfig {
+	if config == nil {
+		return nil
+	}
+	parallelism := config.Parallelism
+	return &ComposeUpdateConfig{
+		Parallelism:     &parallelism,
+		Delay:           composeDuration(&config.Delay),
+		FailureAction:   config.FailureAction,
+		Monitor:         composeDuration(&config.Monitor),
+		MaxFailureRatio: config.MaxFailureRatio,
+		Order:           config.Order,
+	}
+}
+
+func composeDuration(d *time.Duration) string {
+	if d == nil || *d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func composeCPUs(nanoCPUs int64) string {
+	if nanoCPUs == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%g", float64(nanoCPUs)/1e9)
+}
+
+func composeMemory(bytes int64) string {
+	if bytes == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%db", bytes)
+}
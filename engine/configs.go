@@ -0,0 +1,299 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+	"golang.org/x/net/context"
+)
+
+const configLabel = "whaleprint.config"
+
+// ConfigPlan is the swarm config expected for a bundle config. ID is empty
+// when the config needs to be created. Previous holds the content of the
+// config version currently in use, if any.
+type ConfigPlan struct {
+	Name     string
+	ID       string
+	Spec     swarm.ConfigSpec
+	External bool
+	Previous []byte
+}
+
+// planConfigs finds the swarm configs matching the stack bundle configs.
+// Configs are immutable so their names are content hashed, a new config is
+// planned whenever the content changes. It also returns the stack configs
+// which are no longer used.
+func planConfigs(ctx context.Context, cli client.APIClient, stack Stack) (map[string]*ConfigPlan, []swarm.Config, error) {
+	filter := filters.NewArgs()
+	filter.Add("label", "com.docker.stack.namespace="+stack.Name)
+	existing, err := cli.ConfigList(ctx, types.ConfigListOptions{Filters: filter})
+	if err != nil {
+		return nil, nil, apiError(err)
+	}
+
+	planner := &configPlanner{stack: stack, existing: existing, plans: map[string]*ConfigPlan{}}
+	used, err := planObjects(ctx, cli, planner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unused := []swarm.Config{}
+	for _, c := range existing {
+		if _, managed := c.Spec.Labels[configLabel]; managed && !used[c.ID] {
+			unused = append(unused, c)
+		}
+	}
+
+	return planner.plans, unused, nil
+}
+
+// configPlanner plans the configs of a stack with objectPlanner
+type configPlanner struct {
+	stack    Stack
+	existing []swarm.Config
+	plans    map[string]*ConfigPlan
+}
+
+func (p *configPlanner) kind() string {
+	return "config"
+}
+
+func (p *configPlanner) names() []string {
+	return SortedKeys(p.stack.Bundle.Configs)
+}
+
+func (p *configPlanner) isExternal(name string) bool {
+	return p.stack.Bundle.Configs[name].External
+}
+
+func (p *configPlanner) planExternal(ctx context.Context, cli client.APIClient, name string) (string, error) {
+	config := p.stack.Bundle.Configs[name]
+	configName := config.Name
+	if configName == "" {
+		configName = name
+	}
+
+	filter := filters.NewArgs()
+	filter.Add("name", configName)
+	configs, err := cli.ConfigList(ctx, types.ConfigListOptions{Filters: filter})
+	if err != nil {
+		return "", apiError(err)
+	}
+
+	for _, c := range configs {
+		if c.Spec.Name == configName {
+			p.plans[name] = &ConfigPlan{Name: name, ID: c.ID, Spec: c.Spec, External: true}
+			return c.ID, nil
+		}
+	}
+	return "", validationErrorf("External config %s not found", configName)
+}
+
+func (p *configPlanner) read(name string) ([]byte, error) {
+	return readConfig(p.stack, p.stack.Bundle.Configs[name])
+}
+
+func (p *configPlanner) planManaged(name string, data []byte, hash string) (string, error) {
+	plan := &ConfigPlan{
+		Name: name,
+		Spec: swarm.ConfigSpec{
+			Annotations: swarm.Annotations{
+				Name: fmt.Sprintf("%s_%s_%s", p.stack.Name, name, hash[:12]),
+				Labels: map[string]string{
+					"com.docker.stack.namespace": p.stack.Name,
+					configLabel:                  name,
+				},
+			},
+			Data: data,
+		},
+	}
+	p.plans[name] = plan
+
+	var previous *swarm.Config
+	for i, c := range p.existing {
+		if c.Spec.Labels[configLabel] != name {
+			continue
+		}
+		if c.Spec.Name == plan.Spec.Name {
+			plan.ID = c.ID
+		} else if previous == nil || c.CreatedAt.After(previous.CreatedAt) {
+			previous = &p.existing[i]
+		}
+	}
+
+	if plan.ID == "" && previous != nil {
+		plan.Previous = previous.Spec.Data
+	}
+	return plan.ID, nil
+}
+
+// placeholderRegexp matches the ${VAR} references of config templates and the
+// $$ escapes of literal dollar signs
+var placeholderRegexp = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// readConfig reads the config content, expanding the ${VAR} references and
+// $$ escapes if it's a template. Bare $name references are kept since they're
+// common in nginx or shell configs.
+func readConfig(stack Stack, config Config) ([]byte, error) {
+	data, err := readSource(stack, config.File, "")
+	if err != nil || !config.Template {
+		return data, err
+	}
+
+	missing := []string{}
+	expanded := placeholderRegexp.ReplaceAllStringFunc(string(data), func(placeholder string) string {
+		if placeholder == "$$" {
+			return "$"
+		}
+		name := placeholderRegexp.FindStringSubmatch(placeholder)[1]
+		value, found := os.LookupEnv(name)
+		if !found {
+			missing = append(missing, name)
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return []byte(expanded), nil
+}
+
+// applyConfigReferences mounts the planned configs in the expected services
+func applyConfigReferences(stack Stack, services Services, configs map[string]*ConfigPlan) error {
+	for name, bundleService := range stack.Bundle.Services {
+		serviceName := GetServiceName(stack.Name, name, bundleService)
+		service, found := services[serviceName]
+		if !found || len(bundleService.Configs) == 0 {
+			continue
+		}
+
+		refs := []*swarm.ConfigReference{}
+		for _, ref := range bundleService.Configs {
+			plan, found := configs[ref.Source]
+			if !found {
+				return validationErrorf("Service %s references undefined config %s", serviceName, ref.Source)
+			}
+
+			target, err := getFileTarget(ref.Source, ref.Target, ref.UID, ref.GID, ref.Mode, 0444)
+			if err != nil {
+				return validationErrorf("Invalid config %s for service %s: %s", ref.Source, serviceName, err)
+			}
+
+			refs = append(refs, &swarm.ConfigReference{
+				File: &swarm.ConfigReferenceFileTarget{
+					Name: target.Name,
+					UID:  target.UID,
+					GID:  target.GID,
+					Mode: target.Mode,
+				},
+				ConfigID:   plan.ID,
+				ConfigName: plan.Spec.Name,
+			})
+		}
+
+		service.Spec.TaskTemplate.ContainerSpec.Configs = refs
+		services[serviceName] = service
+	}
+	return nil
+}
+
+// createConfigs creates the planned configs which don't exist yet and updates
+// the references of the expected services with their IDs.
+func createConfigs(ctx context.Context, cli client.APIClient, configs map[string]*ConfigPlan, services Services, opts ApplyOptions) error {
+	for _, name := range SortedKeys(configs) {
+		plan := configs[name]
+		if plan.ID != "" {
+			continue
+		}
+
+		opts.progress("create", "config", plan.Spec.Name)
+		resp, err := cli.ConfigCreate(ctx, plan.Spec)
+		if err != nil {
+			return apiError(err)
+		}
+		opts.done()
+		plan.ID = resp.ID
+
+		for _, service := range services {
+			for _, ref := range service.Spec.TaskTemplate.ContainerSpec.Configs {
+				if ref.ConfigName == plan.Spec.Name {
+					ref.ConfigID = plan.ID
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// removeConfigs garbage collects the configs which are no longer used by the
+// stack. Configs still in use by services outside the plan are kept.
+func removeConfigs(ctx context.Context, cli client.APIClient, configs []swarm.Config, opts ApplyOptions) {
+	for _, config := range configs {
+		opts.progress("remove", "config", config.Spec.Name)
+		if err := cli.ConfigRemove(ctx, config.ID); err != nil {
+			opts.warn("unable to remove config %s: %s", config.Spec.Name, err)
+			continue
+		}
+		opts.done()
+	}
+}
+
+// printContentDiff writes a line based diff between the current and the
+// expected content
+func printContentDiff(w io.Writer, current, expected []byte) {
+	a := splitLines(current)
+	b := splitLines(expected)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	red := color.New(color.FgRed).SprintFunc()
+	green := color.New(color.FgGreen).SprintFunc()
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(w, "     %s\n", a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(w, "   %s\n", green("+ "+b[j]))
+			j++
+		default:
+			fmt.Fprintf(w, "   %s\n", red("- "+a[i]))
+			i++
+		}
+	}
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"reflect"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	"github.com/docker/docker/api/client/stack"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// Services are swarm services keyed by name
+type Services map[string]swarm.Service
+
+// Keys returns the sorted names of the services
+func (s Services) Keys() []string {
+	return SortedKeys(s)
+}
+
+// Targets returns the services in targetMap, all of them if it's empty
+func (s Services) Targets(targetMap map[string]bool) Services {
+	if len(targetMap) == 0 {
+		return s
+	}
+
+	targets := Services{}
+	for name, service := range s {
+		if targetMap[name] {
+			targets[name] = service
+		}
+	}
+	return targets
+}
+
+// SortedKeys returns the sorted keys of m, which must be a map with string
+// keys
+func SortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func safeDereference(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// TranslateNetworkToIds replaces the stack network names the services are
+// attached to with the IDs of the existing networks
+func TranslateNetworkToIds(ctx context.Context, cli client.APIClient, services Services, stackName string) error {
+	existingNetworks, err := stack.GetNetworks(ctx, cli, stackName)
+	if err != nil {
+		return apiErrorf("Error retrieving networks of stack %s: %s", stackName, err)
+	}
+
+	for _, service := range services {
+		for i, network := range service.Spec.Networks {
+			for _, enet := range existingNetworks {
+				if enet.Name == network.Target {
+					service.Spec.Networks[i].Target = enet.ID
+					network.Target = enet.ID
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// GetBundleServicesSpec converts the bundle services to the swarm services
+// expected for the stack, keyed by their swarm name
+func GetBundleServicesSpec(bundle *Bundlefile, stackName string) (Services, error) {
+	specs := Services{}
+
+	for name, service := range bundle.Services {
+		spec := swarm.ServiceSpec{
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: swarm.ContainerSpec{
+					Image:   service.Image,
+					Labels:  getContainerLabels(service.ServiceLabels, stackName),
+					Command: service.Command,
+					Args:    service.Args,
+					Env:     service.Env,
+					Dir:     safeDereference(service.WorkingDir),
+					User:    safeDereference(service.User),
+					Mounts:  service.Mounts,
+				},
+				Resources:     service.Resources,
+				RestartPolicy: service.RestartPolicy,
+				Placement:     convertPlacement(service.Constraints, service.Placement),
+			},
+			Networks:       convertNetworks(service.Networks, stackName, name),
+			UpdateConfig:   service.UpdateConfig,
+			RollbackConfig: service.RollbackConfig,
+		}
+
+		healthcheck, err := convertHealthcheck(service.Healthcheck)
+		if err != nil {
+			return nil, validationErrorf("Invalid healthcheck for service %s: %s", GetServiceName(stackName, name, service), err)
+		}
+		spec.TaskTemplate.ContainerSpec.Healthcheck = healthcheck
+
+		logDriver, err := convertLogging(bundle.Logging, service.Logging)
+		if err != nil {
+			return nil, validationErrorf("Invalid logging for service %s: %s", GetServiceName(stackName, name, service), err)
+		}
+		spec.TaskTemplate.LogDriver = logDriver
+
+		spec.Mode = getServiceMode(service.Mode)
+
+		if service.Replicas != nil {
+			if spec.Mode.Replicated == nil {
+				return nil, validationErrorf("Invalid replicas for service %s: global services can't set them", GetServiceName(stackName, name, service))
+			}
+			spec.Mode.Replicated.Replicas = service.Replicas
+		}
+
+		spec.Labels = map[string]string{"com.docker.stack.namespace": stackName}
+
+		for name, value := range service.Labels {
+			spec.Labels[name] = value
+		}
+
+		if service.preventDestroy() {
+			spec.Labels[protectLabel] = "true"
+		}
+
+		spec.Name = GetServiceName(stackName, name, service)
+
+		// Populate ports
+		ports := convertPorts(service.Ports)
+
+		// Hardcode resolution mode to VIP as it's the default with dab
+		mode := "vip"
+		if service.EndpointMode != nil {
+			if *service.EndpointMode != "dnsrr" && *service.EndpointMode != "vip" {
+				return nil, validationErrorf("Invalid mode \"%s\" for service %s, only \"dnsrr\" or \"vip\" is allowed", *service.EndpointMode, spec.Name)
+			}
+			mode = *service.EndpointMode
+		}
+		spec.EndpointSpec = &swarm.EndpointSpec{Ports: ports, Mode: swarm.ResolutionMode(mode)}
+
+		service := swarm.Service{}
+		service.ID = spec.Name
+		service.Spec = spec
+
+		specs[spec.Name] = service
+	}
+	return specs, nil
+}
+
+func getServiceMode(mode *string) swarm.ServiceMode {
+	if mode != nil && *mode == "global" {
+		return swarm.ServiceMode{
+			Global: &swarm.GlobalService{},
+		}
+	} else {
+		// Every spec gets its own count so changing one doesn't change the others
+		replicas := uint64(1)
+		return swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{
+				Replicas: &replicas,
+			},
+		}
+	}
+}
+
+func convertNetworks(networks []string, namespace string, name string) []swarm.NetworkAttachmentConfig {
+	nets := []swarm.NetworkAttachmentConfig{}
+	for _, network := range networks {
+		nets = append(nets, swarm.NetworkAttachmentConfig{
+			Target:  namespace + "_" + network,
+			Aliases: []string{network, name},
+		})
+	}
+	return nets
+}
+
+// isDefaultAliases tells whether the aliases of a service on a stack network
+// are the ones convertNetworks sets
+func isDefaultAliases(aliases []string, network string, name string) bool {
+	return len(aliases) == 2 && aliases[0] == network && aliases[1] == name
+}
+
+func getContainerLabels(serviceLabels map[string]string, stackName string) map[string]string {
+	labels := map[string]string{"com.docker.stack.namespace": stackName}
+	for name, value := range serviceLabels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// GetSwarmServicesSpecForStack keys the live services of a stack by name,
+// normalizing where their networks are attached
+func GetSwarmServicesSpecForStack(services []swarm.Service) Services {
+	specs := Services{}
+
+	for _, service := range services {
+		specs[service.Spec.Name] = normalizeService(service)
+	}
+
+	return specs
+}
+
+// normalizeService moves the networks newer daemons attach to the task
+// template to the service spec, where whaleprint sets them
+func normalizeService(service swarm.Service) swarm.Service {
+	if len(service.Spec.Networks) == 0 && len(service.Spec.TaskTemplate.Networks) > 0 {
+		service.Spec.Networks = service.Spec.TaskTemplate.Networks
+		service.Spec.TaskTemplate.Networks = nil
+	}
+	return service
+}
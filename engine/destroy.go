@@ -0,0 +1,33 @@
+package engine
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// GetDestroyServices returns the names of the services of the stack bundle,
+// which destroying the stack removes. Protected services are refused unless
+// they are allowed to be destroyed.
+func GetDestroyServices(ctx context.Context, cli client.APIClient, stack Stack, allowDestroy map[string]bool) ([]string, error) {
+	filter := filters.NewArgs()
+	filter.Add("label", "com.docker.stack.namespace="+stack.Name)
+	existing, err := cli.ServiceList(ctx, types.ServiceListOptions{Filters: filter})
+	if err != nil {
+		return nil, apiError(err)
+	}
+	current := GetSwarmServicesSpecForStack(existing)
+
+	services := []string{}
+	for name, service := range stack.Bundle.Services {
+		serviceName := GetServiceName(stack.Name, name, service)
+		cs, found := current[serviceName]
+		if (service.preventDestroy() || (found && IsProtected(cs))) && !allowDestroy[serviceName] && !allowDestroy[name] {
+			return nil, conflictErrorf("Refusing to destroy protected service %s, use --allow-destroy=%s to allow it", serviceName, name)
+		}
+		services = append(services, serviceName)
+	}
+	return services, nil
+}
@@ -1,35 +1,60 @@
-package main
+package engine
 
 import (
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"reflect"
 	"strings"
 
-	"github.com/docker/docker/api/client/bundlefile"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/fatih/color"
 )
 
 var yellow = color.New(color.FgYellow)
 
-type Stack struct {
-	Name   string
-	Bundle *bundlefile.Bundlefile
+// IsProtected reports whether the service is protected from being destroyed
+func IsProtected(service swarm.Service) bool {
+	return service.Spec.Labels[protectLabel] == "true"
 }
 
+// isDestroyAllowed reports whether a protected service of the stack was
+// allowed to be destroyed, either by its DAB name or by its full name
+func isDestroyAllowed(allowDestroy map[string]bool, stackName, serviceName string) bool {
+	return allowDestroy[serviceName] || allowDestroy[GetBundleServiceKey(serviceName, stackName)]
+}
+
+const sensitiveValue = "<sensitive>"
+
+// DiffRecord is a property whose current value differs from the expected one
+type DiffRecord struct {
+	Path     string
+	Current  string
+	Expected string
+}
+
+// ServicePrinter writes service specs and the differences between them to w.
+// Environment values matching the redactor are masked, nil masks the ones
+// matching the built-in patterns.
 type ServicePrinter struct {
 	w           io.Writer
 	detail      bool
+	redactor    *Redactor
 	isDifferent bool
+	records     []DiffRecord
+	err         error
 }
 
-func NewServicePrinter(w io.Writer, detail bool) *ServicePrinter {
-	return &ServicePrinter{w: w, detail: detail}
+// NewServicePrinter returns a printer writing to w, which prints every
+// property in detail mode and only the differences otherwise
+func NewServicePrinter(w io.Writer, detail bool, redactor *Redactor) *ServicePrinter {
+	if redactor == nil {
+		redactor = DefaultRedactor()
+	}
+	return &ServicePrinter{w: w, detail: detail, redactor: redactor}
 }
 
+// PrintServiceSpec writes every property of the spec
 func (sp *ServicePrinter) PrintServiceSpec(spec swarm.ServiceSpec) {
 	sp.isDifferent = false
 	sp._printServiceSpec("", spec)
@@ -62,15 +87,24 @@ func (sp *ServicePrinter) _printServiceSpec(namespace string, current interface{
 			}
 		}
 	default:
-		sc := fmt.Sprint(current)
+		sc := sp.mask(namespace, fmt.Sprint(current))
 		sp.println(nil, namespace, sc)
 	}
 }
 
-func (sp *ServicePrinter) PrintServiceSpecDiff(current, expected swarm.ServiceSpec) bool {
+// PrintServiceSpecDiff writes the properties which differ between both specs,
+// or all of them in detail mode, and reports whether there's any difference
+func (sp *ServicePrinter) PrintServiceSpecDiff(current, expected swarm.ServiceSpec) (bool, error) {
 	sp.isDifferent = false
+	sp.records = nil
+	sp.err = nil
 	sp._printServiceSpecDiff("", current, expected)
-	return sp.isDifferent
+	return sp.isDifferent, sp.err
+}
+
+// Records returns the differences found by the last PrintServiceSpecDiff
+func (sp *ServicePrinter) Records() []DiffRecord {
+	return sp.records
 }
 
 func (sp *ServicePrinter) _printServiceSpecDiff(namespace string, current, expected interface{}) {
@@ -79,8 +113,13 @@ func (sp *ServicePrinter) _printServiceSpecDiff(namespace string, current, expec
 	currentValue := reflect.ValueOf(current)
 	expectedValue := reflect.ValueOf(expected)
 
+	if sp.err != nil {
+		return
+	}
+
 	if currentType != expectedType {
-		log.Fatal("Types are different ", currentType, expectedType)
+		sp.err = validationErrorf("Can't compare %s, types are different: %s and %s", namespace, currentType, expectedType)
+		return
 	}
 
 	switch currentType.Kind() {
@@ -155,7 +194,20 @@ func (sp *ServicePrinter) _printServiceSpecDiff(namespace string, current, expec
 		sc := fmt.Sprint(current)
 		se := fmt.Sprint(expected)
 
+		comparison := imageDifferent
 		if sc == se {
+			comparison = imageSame
+		} else if namespace == imageNamespace {
+			comparison = compareImages(sc, se)
+		}
+
+		mc, me := sp.mask(namespace, sc), sp.mask(namespace, se)
+		if mc == me && sc != se {
+			// Both values are hidden, still show which one changed
+			me += " (changed)"
+		}
+		sc, se = mc, me
+		if comparison == imageSame {
 			if sp.detail {
 				sp.printDiffln(nil, namespace, sc, se)
 			}
@@ -166,14 +218,36 @@ func (sp *ServicePrinter) _printServiceSpecDiff(namespace string, current, expec
 			}
 
 			sp.isDifferent = true
+			sp.records = append(sp.records, DiffRecord{Path: namespace, Current: sc, Expected: se})
 			sp.printDiffln(c, namespace, sc, se)
+			if comparison == imageNewDigest {
+				fmt.Fprintf(sp.w, "   %s\n", yellow.SprintFunc()("(image tag now points to a new digest)"))
+			}
 		}
 	}
 }
 
-func (sp *ServicePrinter) println(c *color.Color, namespace, current string) {
+// mask hides the values of sensitive environment variables, which are
+// compared unmasked
+func (sp *ServicePrinter) mask(namespace, value string) string {
+	if strings.HasPrefix(namespace, envNamespace+"[") {
+		return sp.redactor.Mask(value)
+	}
+	return value
+}
+
+// padding aligns the values after the property paths, longer paths are
+// separated with a single space
+func padding(namespace string) string {
 	spaces := 70 - len(namespace)
-	spaceString := strings.Repeat(" ", spaces)
+	if spaces < 1 {
+		spaces = 1
+	}
+	return strings.Repeat(" ", spaces)
+}
+
+func (sp *ServicePrinter) println(c *color.Color, namespace, current string) {
+	spaceString := padding(namespace)
 	if c != nil {
 		namespace = c.SprintFunc()(namespace)
 		current = c.SprintFunc()(current)
@@ -182,8 +256,7 @@ func (sp *ServicePrinter) println(c *color.Color, namespace, current string) {
 }
 func (sp *ServicePrinter) printDiffln(c *color.Color, namespace, current, expected string) {
 	action := "=>"
-	spaces := 70 - len(namespace)
-	spaceString := strings.Repeat(" ", spaces)
+	spaceString := padding(namespace)
 	if c != nil {
 		namespace = c.SprintFunc()(namespace)
 		current = c.SprintFunc()(current)
@@ -0,0 +1,7 @@
+// Package engine holds the whaleprint logic: loading DAB stacks, converting
+// them to swarm service specs, diffing them against the live services,
+// applying the changes and exporting live services back to DABs or compose
+// files. Functions talk to docker through a client.APIClient and return their
+// results and warnings instead of printing them, the whaleprint CLI is a thin
+// layer over this package. Errors are classified with an ErrorKind.
+package engine
@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorKind classifies the errors returned by the engine
+type ErrorKind int
+
+const (
+	// UnknownError is the kind of errors not returned by the engine
+	UnknownError ErrorKind = iota
+	// LoadError is returned when local files like DABs, lockfiles, secret
+	// sources or credentials can't be read or written
+	LoadError
+	// ValidationError is returned when a bundle or an option is invalid
+	ValidationError
+	// APIError is returned when a docker API call fails
+	APIError
+	// ConflictError is returned when the swarm state prevents the operation:
+	// locked stacks, protected services, concurrent updates or existing files
+	ConflictError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case LoadError:
+		return "load error"
+	case ValidationError:
+		return "validation error"
+	case APIError:
+		return "API error"
+	case ConflictError:
+		return "conflict"
+	default:
+		return "unknown error"
+	}
+}
+
+// Error is an engine error of a known kind
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the kind of the error, UnknownError if it isn't an engine
+// error
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return UnknownError
+}
+
+// wrapError classifies err as kind unless it was already classified
+func wrapError(kind ErrorKind, err error) error {
+	if err == nil || KindOf(err) != UnknownError {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// wrapErrorf returns a new error with the same kind as err, or kind if err
+// wasn't classified
+func wrapErrorf(kind ErrorKind, err error, format string, args ...interface{}) error {
+	if k := KindOf(err); k != UnknownError {
+		kind = k
+	}
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+func loadError(err error) error {
+	return wrapError(LoadError, err)
+}
+
+func apiError(err error) error {
+	return wrapError(APIError, err)
+}
+
+func validationErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: ValidationError, Err: fmt.Errorf(format, args...)}
+}
+
+func conflictErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: ConflictError, Err: fmt.Errorf(format, args...)}
+}
+
+func loadErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: LoadError, Err: fmt.Errorf(format, args...)}
+}
+
+func apiErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: APIError, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/docker/api/client/bundlefile"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+)
+
+// GroupByStack groups the services by their namespace label. Only the given
+// stacks are included, all of them if there are none, and services without
+// stack only when unlabelled is set.
+func GroupByStack(services []swarm.Service, stackNames map[string]bool, unlabelled bool) map[string][]swarm.Service {
+	stacks := map[string][]swarm.Service{}
+	for _, service := range services {
+		stackName := GetStackName(service.Spec.Labels)
+
+		if _, labelled := service.Spec.Labels["com.docker.stack.namespace"]; !labelled && !unlabelled {
+			continue
+		}
+
+		if len(stackNames) > 0 && !stackNames[stackName] {
+			continue
+		}
+
+		stacks[stackName] = append(stacks[stackName], service)
+	}
+	return stacks
+}
+
+// ExportMismatch is a live service which doesn't round-trip through plan
+// after being exported. Expected is nil if the service wasn't exported.
+type ExportMismatch struct {
+	Current  swarm.Service
+	Expected *swarm.Service
+}
+
+// VerifyExport plans the exported bundles against the live services, which
+// must produce no changes for every service whaleprint can model. Services
+// without stack can't be planned and are skipped.
+func VerifyExport(ctx context.Context, cli client.APIClient, bundles map[string]*Bundlefile) ([]ExportMismatch, error) {
+	mismatches := []ExportMismatch{}
+	sp := NewServicePrinter(ioutil.Discard, false, nil)
+	for stackName, bundle := range bundles {
+		if stackName == GetStackName(nil) {
+			continue
+		}
+
+		stack := Stack{Name: stackName, File: fmt.Sprintf("%s.dab", stackName), Bundle: bundle}
+		p, err := GetStackPlan(ctx, cli, stack, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, n := range p.Current.Keys() {
+			es, found := p.Expected[n]
+			if !found {
+				mismatches = append(mismatches, ExportMismatch{Current: p.Current[n]})
+				continue
+			}
+
+			different, err := sp.PrintServiceSpecDiff(p.Current[n].Spec, es.Spec)
+			if err != nil {
+				return nil, err
+			}
+			if different {
+				mismatches = append(mismatches, ExportMismatch{Current: p.Current[n], Expected: &es})
+			}
+		}
+	}
+
+	return mismatches, nil
+}
+
+// GetStackName returns the stack of a service given its labels, "services"
+// for services without stack
+func GetStackName(labels map[string]string) string {
+	if stackName, ok := labels["com.docker.stack.namespace"]; ok {
+		return stackName
+	}
+	return "services"
+
+}
+
+// Exporter converts live services back to their DAB or compose definition
+type Exporter struct {
+	networks map[string]string
+	secrets  map[string]swarm.Secret
+	configs  map[string]swarm.Config
+}
+
+// NewExporter returns an exporter for the networks, secrets and configs of
+// the swarm
+func NewExporter(ctx context.Context, cli client.APIClient) (*Exporter, error) {
+	e := &Exporter{
+		networks: map[string]string{},
+		secrets:  map[string]swarm.Secret{},
+		configs:  map[string]swarm.Config{},
+	}
+
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return nil, apiError(err)
+	}
+	for _, network := range networks {
+		e.networks[network.ID] = network.Name
+	}
+
+	secrets, err := cli.SecretList(ctx, types.SecretListOptions{})
+	if err != nil {
+		return nil, apiError(err)
+	}
+	for _, secret := range secrets {
+		e.secrets[secret.ID] = secret
+	}
+
+	configs, err := cli.ConfigList(ctx, types.ConfigListOptions{})
+	if err != nil {
+		return nil, apiError(err)
+	}
+	for _, config := range configs {
+		e.configs[config.ID] = config
+	}
+
+	return e, nil
+}
+
+// NetworkName returns the name of the network with the given ID, or the ID
+// itself if it doesn't exist
+func (e *Exporter) NetworkName(id string) string {
+	if name, found := e.networks[id]; found {
+		return name
+	}
+	return id
+}
+
+// GetBundleService returns the DAB definition of the service. Secrets and
+// configs used by the service are added to the bundle as external ones since
+// their content can't be exported.
+func (e *Exporter) GetBundleService(service swarm.Service, stackName string, bundle *Bundlefile) (*Service, error) {
+	spec := service.Spec
+	containerSpec := spec.TaskTemplate.ContainerSpec
+
+	serviceBundle := &Service{}
+	serviceBundle.Service = bundlefile.Service{
+		Image:         containerSpec.Image,
+		ServiceLabels: withoutLabels(containerSpec.Labels, "com.docker.stack.namespace"),
+		Labels:        withoutLabels(spec.Labels, "com.docker.stack.namespace", protectLabel),
+		Command:       containerSpec.Command,
+		Args:          containerSpec.Args,
+		Env:           containerSpec.Env,
+		Networks:      []string{},
+	}
+
+	// Services not named after the stack keep their own name
+	if GetBundleServiceKey(spec.Name, stackName) == spec.Name {
+		serviceBundle.Name = spec.Name
+	}
+
+	if containerSpec.Dir != "" {
+		serviceBundle.WorkingDir = &containerSpec.Dir
+	}
+	if containerSpec.User != "" {
+		serviceBundle.User = &containerSpec.User
+	}
+
+	serviceBundle.Mounts = containerSpec.Mounts
+	serviceBundle.Resources = spec.TaskTemplate.Resources
+	serviceBundle.RestartPolicy = spec.TaskTemplate.RestartPolicy
+	serviceBundle.UpdateConfig = spec.UpdateConfig
+	serviceBundle.RollbackConfig = spec.RollbackConfig
+	serviceBundle.Healthcheck = getBundleHealthcheck(containerSpec.Healthcheck)
+	serviceBundle.Logging = getBundleLogging(spec.TaskTemplate.LogDriver)
+	serviceBundle.Placement = getBundlePlacement(spec.TaskTemplate.Placement)
+	if spec.TaskTemplate.Placement != nil {
+		serviceBundle.Constraints = spec.TaskTemplate.Placement.Constraints
+	}
+
+	if IsProtected(service) {
+		serviceBundle.Lifecycle = &Lifecycle{PreventDestroy: true}
+	}
+
+	if spec.Mode.Global != nil {
+		global := "global"
+		serviceBundle.Mode = &global
+	} else {
+		serviceBundle.Replicas = spec.Mode.Replicated.Replicas
+	}
+
+	if spec.EndpointSpec != nil {
+		serviceBundle.Ports = getBundlePorts(spec.EndpointSpec.Ports)
+		if spec.EndpointSpec.Mode == swarm.ResolutionModeDNSRR {
+			mode := string(spec.EndpointSpec.Mode)
+			serviceBundle.EndpointMode = &mode
+		}
+	}
+
+	networks := spec.Networks
+	if len(networks) == 0 {
+		networks = spec.TaskTemplate.Networks
+	}
+	for _, net := range networks {
+		name := e.NetworkName(net.Target)
+		serviceBundle.Networks = append(serviceBundle.Networks, strings.TrimPrefix(name, stackName+"_"))
+	}
+
+	for _, ref := range containerSpec.Secrets {
+		name := ref.SecretName
+		if secret, found := e.secrets[ref.SecretID]; found && secret.Spec.Labels[secretLabel] != "" {
+			name = secret.Spec.Labels[secretLabel]
+		}
+		if bundle.Secrets == nil {
+			bundle.Secrets = map[string]Secret{}
+		}
+		bundle.Secrets[name] = Secret{External: true, Name: ref.SecretName}
+
+		secretRef := SecretReference{Source: name}
+		if ref.File != nil {
+			secretRef.Target = ref.File.Name
+			secretRef.UID = ref.File.UID
+			secretRef.GID = ref.File.GID
+			secretRef.Mode = fmt.Sprintf("%04o", uint32(ref.File.Mode))
+		}
+		serviceBundle.Secrets = append(serviceBundle.Secrets, secretRef)
+	}
+
+	for _, ref := range containerSpec.Configs {
+		name := ref.ConfigName
+		if config, found := e.configs[ref.ConfigID]; found && config.Spec.Labels[configLabel] != "" {
+			name = config.Spec.Labels[configLabel]
+		}
+		if bundle.Configs == nil {
+			bundle.Configs = map[string]Config{}
+		}
+		bundle.Configs[name] = Config{External: true, Name: ref.ConfigName}
+
+		configRef := ConfigReference{Source: name}
+		if ref.File != nil {
+			configRef.Target = ref.File.Name
+			configRef.UID = ref.File.UID
+			configRef.GID = ref.File.GID
+			configRef.Mode = fmt.Sprintf("%04o", uint32(ref.File.Mode))
+		}
+		serviceBundle.Configs = append(serviceBundle.Configs, configRef)
+	}
+
+	return serviceBundle, nil
+}
+
+func withoutLabels(labels map[string]string, exclude ...string) map[string]string {
+	result := map[string]string{}
+	for name, value := range labels {
+		result[name] = value
+	}
+	for _, name := range exclude {
+		delete(result, name)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
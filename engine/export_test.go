@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// roundTripFixtures are live services as whaleprint deploys them, using every
+// property the extended DAB can represent
+func roundTripFixtures() []swarm.Service {
+	replicas := uint64(3)
+	maxAttempts := uint64(5)
+	delay := 10 * time.Second
+	stackLabels := map[string]string{"com.docker.stack.namespace": "vote"}
+
+	web := swarm.Service{ID: "s1"}
+	web.Spec = swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name:   "vote_web",
+			Labels: map[string]string{"com.docker.stack.namespace": "vote", "tier": "front", protectLabel: "true"},
+		},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{
+				Image:   "vote/web:1.0@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				Labels:  map[string]string{"com.docker.stack.namespace": "vote", "app": "web"},
+				Command: []string{"python"},
+				Args:    []string{"app.py"},
+				Env:     []string{"MODE=production"},
+				Dir:     "/app",
+				User:    "www-data",
+				Healthcheck: &container.HealthConfig{
+					Test:     []string{"CMD-SHELL", "curl -f http://localhost/"},
+					Interval: 30 * time.Second,
+					Retries:  3,
+				},
+				Mounts: []mount.Mount{
+					{Type: mount.TypeVolume, Source: "vote_data", Target: "/data"},
+					{Type: mount.TypeBind, Source: "/etc/localtime", Target: "/etc/localtime", ReadOnly: true},
+				},
+				Secrets: []*swarm.SecretReference{{
+					File:       &swarm.SecretReferenceFileTarget{Name: "db_password", UID: "0", GID: "0", Mode: 0400},
+					SecretID:   "secret1",
+					SecretName: "vote_db_password_v2",
+				}},
+				Configs: []*swarm.ConfigReference{{
+					File:       &swarm.ConfigReferenceFileTarget{Name: "/etc/nginx.conf", UID: "0", GID: "0", Mode: 0444},
+					ConfigID:   "config1",
+					ConfigName: "vote_nginx_0123456789ab",
+				}},
+			},
+			Resources: &swarm.ResourceRequirements{
+				Limits:       &swarm.Limit{NanoCPUs: 500000000, MemoryBytes: 268435456},
+				Reservations: &swarm.Resources{MemoryBytes: 134217728},
+			},
+			RestartPolicy: &swarm.RestartPolicy{Condition: swarm.RestartPolicyConditionOnFailure, Delay: &delay, MaxAttempts: &maxAttempts},
+			Placement: &swarm.Placement{
+				Constraints: []string{"node.role == worker"},
+				Preferences: []swarm.PlacementPreference{{Spread: &swarm.SpreadOver{SpreadDescriptor: "node.labels.datacenter"}}},
+				MaxReplicas: 2,
+			},
+			LogDriver: &swarm.Driver{Name: "syslog", Options: map[string]string{"syslog-address": "udp://1.2.3.4:514"}},
+		},
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		UpdateConfig: &swarm.UpdateConfig{
+			Parallelism:   2,
+			Delay:         10 * time.Second,
+			FailureAction: swarm.UpdateFailureActionRollback,
+			Order:         swarm.UpdateOrderStartFirst,
+		},
+		RollbackConfig: &swarm.UpdateConfig{Parallelism: 1, FailureAction: swarm.UpdateFailureActionPause},
+		Networks: []swarm.NetworkAttachmentConfig{
+			{Target: "net1", Aliases: []string{"front", "web"}},
+			{Target: "net2", Aliases: []string{"back", "web"}},
+		},
+		EndpointSpec: &swarm.EndpointSpec{
+			Mode: swarm.ResolutionModeVIP,
+			Ports: []swarm.PortConfig{
+				{Protocol: swarm.PortConfigProtocolTCP, TargetPort: 80, PublishedPort: 8080, PublishMode: swarm.PortConfigPublishModeIngress},
+				{Protocol: swarm.PortConfigProtocolUDP, TargetPort: 53, PublishedPort: 53, PublishMode: swarm.PortConfigPublishModeHost},
+			},
+		},
+	}
+
+	worker := swarm.Service{ID: "s2"}
+	worker.Spec = swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "vote_worker", Labels: stackLabels},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{
+				Image:       "vote/worker:latest",
+				Labels:      stackLabels,
+				Healthcheck: &container.HealthConfig{Test: []string{"NONE"}},
+			},
+			Placement: &swarm.Placement{},
+		},
+		Mode: swarm.ServiceMode{Global: &swarm.GlobalService{}},
+		// Newer daemons report the networks in the task template
+		EndpointSpec: &swarm.EndpointSpec{Mode: swarm.ResolutionModeDNSRR, Ports: []swarm.PortConfig{}},
+	}
+	worker.Spec.TaskTemplate.Networks = []swarm.NetworkAttachmentConfig{{Target: "net2", Aliases: []string{"back", "worker"}}}
+
+	// Services not named after the stack keep their own name
+	legacy := swarm.Service{ID: "s3"}
+	legacy.Spec = swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "redis", Labels: stackLabels},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{Image: "redis:alpine", Labels: stackLabels},
+			Placement:     &swarm.Placement{},
+		},
+		Mode:         swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		Networks:     []swarm.NetworkAttachmentConfig{},
+		EndpointSpec: &swarm.EndpointSpec{Mode: swarm.ResolutionModeVIP, Ports: []swarm.PortConfig{}},
+	}
+
+	return []swarm.Service{web, worker, legacy}
+}
+
+// TestExportRoundTrip checks that exporting live services and planning the
+// exported DAB produces no changes
+func TestExportRoundTrip(t *testing.T) {
+	e := &Exporter{
+		networks: map[string]string{"net1": "vote_front", "net2": "vote_back"},
+		secrets: map[string]swarm.Secret{"secret1": {
+			ID:   "secret1",
+			Spec: swarm.SecretSpec{Annotations: swarm.Annotations{Name: "vote_db_password_v2", Labels: map[string]string{secretLabel: "db_password"}}},
+		}},
+		configs: map[string]swarm.Config{"config1": {
+			ID:   "config1",
+			Spec: swarm.ConfigSpec{Annotations: swarm.Annotations{Name: "vote_nginx_0123456789ab", Labels: map[string]string{configLabel: "nginx"}}},
+		}},
+	}
+
+	services := roundTripFixtures()
+	exported := &Bundlefile{Version: "0.1", Services: map[string]Service{}}
+	for _, service := range services {
+		bundleService, err := e.GetBundleService(service, "vote", exported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported.Services[GetBundleServiceKey(service.Spec.Name, "vote")] = *bundleService
+	}
+
+	// Plan reads the DAB written by export
+	var buf bytes.Buffer
+	if err := PrintBundlefile(&buf, exported); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := LoadBundlefile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := Stack{Name: "vote", File: "vote.dab", Bundle: bundle}
+
+	expected, err := GetBundleServicesSpec(bundle, "vote")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What GetStackPlan does with the swarm networks, secrets and configs
+	for _, service := range expected {
+		for i, network := range service.Spec.Networks {
+			for id, name := range e.networks {
+				if name == network.Target {
+					service.Spec.Networks[i].Target = id
+				}
+			}
+		}
+	}
+	secrets := map[string]*SecretPlan{}
+	for _, secret := range e.secrets {
+		secrets[secret.Spec.Labels[secretLabel]] = &SecretPlan{ID: secret.ID, Spec: secret.Spec, External: true}
+	}
+	if err := applySecretReferences(stack, expected, secrets); err != nil {
+		t.Fatal(err)
+	}
+	configs := map[string]*ConfigPlan{}
+	for _, config := range e.configs {
+		configs[config.Spec.Labels[configLabel]] = &ConfigPlan{ID: config.ID, Spec: config.Spec, External: true}
+	}
+	if err := applyConfigReferences(stack, expected, configs); err != nil {
+		t.Fatal(err)
+	}
+
+	current := GetSwarmServicesSpecForStack(services)
+	for _, name := range current.Keys() {
+		es, found := expected[name]
+		if !found {
+			t.Errorf("service %s is missing from the exported DAB", name)
+			continue
+		}
+
+		sp := NewServicePrinter(ioutil.Discard, false, nil)
+		different, err := sp.PrintServiceSpecDiff(current[name].Spec, es.Spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if different {
+			for _, record := range sp.Records() {
+				t.Errorf("service %s doesn't round-trip, %s: %s => %s", name, record.Path, record.Current, record.Expected)
+			}
+		}
+	}
+}
+
+// TestPrintLongPaths checks the paths of the properties exported DABs can set
+// are printed whatever their length
+func TestPrintLongPaths(t *testing.T) {
+	spec := swarm.ServiceSpec{}
+	spec.TaskTemplate.ContainerSpec.Mounts = []mount.Mount{{
+		Type:   mount.TypeVolume,
+		Source: "vote_nfs",
+		Target: "/data",
+		VolumeOptions: &mount.VolumeOptions{
+			DriverConfig: &mount.Driver{Name: "local", Options: map[string]string{"type": "nfs", "o": "addr=10.0.0.1"}},
+		},
+	}}
+
+	var buf bytes.Buffer
+	NewServicePrinter(&buf, true, nil).PrintServiceSpec(spec)
+	if !bytes.Contains(buf.Bytes(), []byte(".VolumeOptions.DriverConfig.Options.type")) {
+		t.Errorf("long path not printed:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+)
+
+const imageNamespace = ".TaskTemplate.ContainerSpec.Image"
+
+type imageComparison int
+
+const (
+	imageSame imageComparison = iota
+	imageNewDigest
+	imageDifferent
+)
+
+// ImageResolver resolves an image reference to the digest currently pointed by it
+type ImageResolver interface {
+	ResolveDigest(ctx context.Context, image string) (string, error)
+}
+
+// DaemonImageResolver resolves digests through the docker daemon, which queries
+// the image registry. Any registry reachable by the daemon can be used, a local
+// registry stand-in included.
+type DaemonImageResolver struct {
+	client client.APIClient
+	auth   *RegistryAuth
+}
+
+// NewDaemonImageResolver returns a resolver querying the registry through
+// the daemon with the registry credentials, nil for anonymous access
+func NewDaemonImageResolver(cli client.APIClient, auth *RegistryAuth) *DaemonImageResolver {
+	return &DaemonImageResolver{client: cli, auth: auth}
+}
+
+// ResolveDigest returns the digest the image tag currently points to
+func (r *DaemonImageResolver) ResolveDigest(ctx context.Context, image string) (string, error) {
+	encodedAuth := ""
+	if r.auth != nil {
+		var err error
+		if encodedAuth, err = r.auth.EncodedAuth(image); err != nil {
+			return "", err
+		}
+	}
+
+	inspect, err := r.client.DistributionInspect(ctx, image, encodedAuth)
+	if err != nil {
+		return "", apiError(err)
+	}
+	return inspect.Descriptor.Digest.String(), nil
+}
+
+// resolveImages pins every image tag of the services to the digest it
+// currently points to. Images which can't be resolved keep their tag and a
+// warning is returned for each of them.
+func resolveImages(ctx context.Context, resolver ImageResolver, services Services) []string {
+	warnings := []string{}
+	for _, n := range services.Keys() {
+		service := services[n]
+		image := service.Spec.TaskTemplate.ContainerSpec.Image
+
+		ref, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("invalid image %s for service %s: %s", image, n, err))
+			continue
+		}
+		if _, digested := ref.(reference.Digested); digested {
+			continue
+		}
+
+		digest, err := resolver.ResolveDigest(ctx, image)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("unable to resolve image %s for service %s: %s", image, n, err))
+			continue
+		}
+
+		service.Spec.TaskTemplate.ContainerSpec.Image = fmt.Sprintf("%s@%s", image, digest)
+		services[n] = service
+	}
+	return warnings
+}
+
+// compareImages compares two image references taking into account that swarm
+// may pin a tag to a digest. A pinned tag is the same image as the bare tag
+// expected, but a bare tag running when the tag is expected pinned may run an
+// older digest and is reported as a new digest.
+func compareImages(current, expected string) imageComparison {
+	if current == expected {
+		return imageSame
+	}
+
+	cname, ctag, cdigest, cerr := splitImage(current)
+	ename, etag, edigest, eerr := splitImage(expected)
+	if cerr != nil || eerr != nil || cname != ename {
+		return imageDifferent
+	}
+
+	if cdigest != "" && edigest != "" {
+		if cdigest == edigest {
+			return imageSame
+		}
+		if ctag != "" && ctag == etag {
+			return imageNewDigest
+		}
+		return imageDifferent
+	}
+
+	if ctag != "" && ctag == etag {
+		if edigest != "" {
+			return imageNewDigest
+		}
+		return imageSame
+	}
+	return imageDifferent
+}
+
+func splitImage(image string) (name, tag, digest string, err error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	name = ref.Name()
+	if tagged, ok := ref.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	if digested, ok := ref.(reference.Digested); ok {
+		digest = digested.Digest().String()
+	} else if tag == "" {
+		tag = "latest"
+	}
+	return name, tag, digest, nil
+}
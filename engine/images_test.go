@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+const (
+	digestA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	digestB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func TestCompareImages(t *testing.T) {
+	tests := []struct {
+		current  string
+		expected string
+		want     imageComparison
+	}{
+		{"redis:alpine", "redis:alpine", imageSame},
+		{"redis", "redis:latest", imageSame},
+		{"redis:alpine", "docker.io/library/redis:alpine", imageSame},
+		{"redis:alpine@" + digestA, "redis:alpine", imageSame},
+		{"redis:alpine@" + digestA, "redis:alpine@" + digestA, imageSame},
+		{"redis:alpine@" + digestA, "redis:alpine@" + digestB, imageNewDigest},
+		{"redis:alpine", "redis:alpine@" + digestA, imageNewDigest},
+		{"redis:alpine", "redis:3.2", imageDifferent},
+		{"redis:alpine", "postgres:alpine", imageDifferent},
+		{"redis@" + digestA, "redis@" + digestB, imageDifferent},
+		{"redis:alpine@" + digestA, "redis:3.2@" + digestB, imageDifferent},
+		{"Invalid:Image", "redis:alpine", imageDifferent},
+	}
+
+	for _, test := range tests {
+		if got := compareImages(test.current, test.expected); got != test.want {
+			t.Errorf("compareImages(%q, %q) = %d, want %d", test.current, test.expected, got, test.want)
+		}
+	}
+}
+
+// fakeResolver stands in for a registry, resolving the images it knows
+type fakeResolver map[string]string
+
+func (r fakeResolver) ResolveDigest(ctx context.Context, image string) (string, error) {
+	digest, found := r[image]
+	if !found {
+		return "", fmt.Errorf("manifest for %s not found", image)
+	}
+	return digest, nil
+}
+
+func TestResolveImages(t *testing.T) {
+	services := Services{}
+	for name, image := range map[string]string{
+		"vote_redis":  "redis:alpine",
+		"vote_db":     "postgres:9.4@" + digestB,
+		"vote_worker": "vote/worker:missing",
+		"vote_result": "Invalid:Image",
+	} {
+		service := swarm.Service{}
+		service.Spec.Name = name
+		service.Spec.TaskTemplate.ContainerSpec.Image = image
+		services[name] = service
+	}
+
+	resolver := fakeResolver{"redis:alpine": digestA}
+	warnings := resolveImages(context.Background(), resolver, services)
+
+	want := map[string]string{
+		"vote_redis":  "redis:alpine@" + digestA,
+		"vote_db":     "postgres:9.4@" + digestB,
+		"vote_worker": "vote/worker:missing",
+		"vote_result": "Invalid:Image",
+	}
+	for name, image := range want {
+		if got := services[name].Spec.TaskTemplate.ContainerSpec.Image; got != image {
+			t.Errorf("image of %s = %q, want %q", name, got, image)
+		}
+	}
+
+	if len(warnings) != 2 {
+		t.Errorf("got %d warnings, want 2: %v", len(warnings), warnings)
+	}
+}
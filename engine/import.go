@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// ImportService adopts an existing service into the stack by adding the stack
+// namespace label to it. Only the service label is set so its tasks aren't
+// rolled. It returns the updated service.
+func ImportService(ctx context.Context, cli client.APIClient, service swarm.Service, stackName string) (swarm.Service, error) {
+	spec := service.Spec
+	spec.Labels = withLabel(spec.Labels, "com.docker.stack.namespace", stackName)
+
+	if _, err := updateService(ctx, cli, service, spec, ""); err != nil {
+		return service, wrapErrorf(APIError, err, "Error importing service %s: %s", spec.Name, err)
+	}
+	service.Spec = spec
+	return service, nil
+}
+
+// keepImportedLabels leaves the stack label out of the container labels of
+// the expected services whose live tasks don't have it, which is the case of
+// imported services, so planning them doesn't roll their tasks
+func keepImportedLabels(current, expected Services) {
+	for name, cs := range current {
+		es, found := expected[name]
+		if !found {
+			continue
+		}
+		if _, labelled := cs.Spec.TaskTemplate.ContainerSpec.Labels["com.docker.stack.namespace"]; labelled {
+			continue
+		}
+
+		es.Spec.TaskTemplate.ContainerSpec.Labels = withoutLabels(es.Spec.TaskTemplate.ContainerSpec.Labels, "com.docker.stack.namespace")
+		expected[name] = es
+	}
+}
+
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	result := map[string]string{name: value}
+	for k, v := range labels {
+		if k != name {
+			result[k] = v
+		}
+	}
+	return result
+}
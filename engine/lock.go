@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"golang.org/x/net/context"
+)
+
+const lockLabel = "whaleprint.lock"
+
+// lockRetryInterval is how often a held lock is checked while waiting for it
+var lockRetryInterval = 2 * time.Second
+
+// StackLock describes who is currently holding the lock of a stack. Locks are
+// stored in the swarm itself as a labelled config object so every whaleprint
+// client talking to the same cluster sees them.
+type StackLock struct {
+	Stack   string
+	Holder  string
+	Host    string
+	Time    time.Time
+	Command string
+}
+
+func (l StackLock) String() string {
+	return fmt.Sprintf("held by %s@%s since %s (%s)", l.Holder, l.Host, l.Time.Format(time.RFC3339), l.Command)
+}
+
+func getLockName(stackName string) string {
+	return fmt.Sprintf("%s_whaleprint-lock", stackName)
+}
+
+func newStackLock(stackName string) StackLock {
+	holder := "unknown"
+	if u, err := user.Current(); err == nil {
+		holder = u.Username
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return StackLock{
+		Stack:   stackName,
+		Holder:  holder,
+		Host:    host,
+		Time:    time.Now().UTC(),
+		Command: strings.Join(os.Args, " "),
+	}
+}
+
+// AcquireLock creates the lock for the stack. If the lock is already held it
+// keeps retrying until timeout expires, calling wait, if set, with the current
+// lock before every retry.
+func AcquireLock(ctx context.Context, swarmClient client.APIClient, stackName string, timeout time.Duration, wait func(StackLock)) error {
+	lock := newStackLock(stackName)
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return validationErrorf("Invalid lock for stack %s: %s", stackName, err)
+	}
+
+	spec := swarm.ConfigSpec{
+		Annotations: swarm.Annotations{
+			Name: getLockName(stackName),
+			Labels: map[string]string{
+				"com.docker.stack.namespace": stackName,
+				lockLabel:                    "true",
+			},
+		},
+		Data: data,
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := swarmClient.ConfigCreate(ctx, spec)
+		if err == nil {
+			return nil
+		}
+		if !errdefs.IsConflict(err) {
+			return apiErrorf("Error acquiring lock for stack %s: %s", stackName, err)
+		}
+
+		current, err := GetLock(ctx, swarmClient, stackName)
+		if err != nil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			if current == nil {
+				return conflictErrorf("Stack %s is locked", stackName)
+			}
+			return conflictErrorf("Stack %s is locked, %s", stackName, current)
+		}
+
+		if current != nil && wait != nil {
+			wait(*current)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// ReleaseLock removes the lock of the stack
+func ReleaseLock(ctx context.Context, swarmClient client.APIClient, stackName string) error {
+	err := swarmClient.ConfigRemove(ctx, getLockName(stackName))
+	if err != nil && !errdefs.IsNotFound(err) {
+		return apiErrorf("Error releasing lock for stack %s: %s", stackName, err)
+	}
+	return nil
+}
+
+// GetLock returns the current lock of the stack or nil if it isn't locked
+func GetLock(ctx context.Context, swarmClient client.APIClient, stackName string) (*StackLock, error) {
+	config, _, err := swarmClient.ConfigInspectWithRaw(ctx, getLockName(stackName))
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, apiError(err)
+	}
+
+	lock := &StackLock{}
+	if err := json.Unmarshal(config.Spec.Data, lock); err != nil {
+		return nil, validationErrorf("Invalid lock found for stack %s: %s", stackName, err)
+	}
+	return lock, nil
+}
+
+// LockStacks acquires the lock of every stack and returns a function which
+// releases them, returning the errors found. If any lock can't be acquired
+// the ones already held are released.
+func LockStacks(ctx context.Context, swarmClient client.APIClient, stacks []Stack, timeout time.Duration, wait func(StackLock)) (func() []error, error) {
+	locked := []string{}
+	release := func() []error {
+		errs := []error{}
+		for _, name := range locked {
+			if err := ReleaseLock(ctx, swarmClient, name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errs
+	}
+
+	for _, stack := range stacks {
+		if err := AcquireLock(ctx, swarmClient, stack.Name, timeout, wait); err != nil {
+			release()
+			return nil, err
+		}
+		locked = append(locked, stack.Name)
+	}
+
+	return release, nil
+}
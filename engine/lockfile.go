@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/distribution/reference"
+	"golang.org/x/net/context"
+)
+
+// Lockfile pins the image of every service of a DAB to the digest it pointed
+// to when it was locked, so deployments are reproducible.
+type Lockfile struct {
+	Version  string
+	Services map[string]LockedImage
+}
+
+// LockedImage is the image of a service as written in the DAB and the digest
+// it resolved to
+type LockedImage struct {
+	Image  string
+	Digest string
+}
+
+// Pinned returns the image reference pinned to the locked digest
+func (l LockedImage) Pinned() string {
+	if _, _, digest, err := splitImage(l.Image); err == nil && digest != "" {
+		return l.Image
+	}
+	return fmt.Sprintf("%s@%s", l.Image, l.Digest)
+}
+
+// GetLockfileName returns the path of the lockfile of a DAB
+func GetLockfileName(dabFile string) string {
+	return dabFile + ".lock"
+}
+
+// LoadLockfile reads the lockfile in path. It returns nil if it doesn't exist.
+func LoadLockfile(path string) (*Lockfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, loadError(err)
+	}
+
+	lock := &Lockfile{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, loadErrorf("Error reading lockfile %s: %s", path, err)
+	}
+	if lock.Services == nil {
+		lock.Services = map[string]LockedImage{}
+	}
+	return lock, nil
+}
+
+// WriteLockfile writes the lockfile to path
+func WriteLockfile(path string, lock *Lockfile) error {
+	data, err := json.MarshalIndent(lock, "", "    ")
+	if err != nil {
+		return loadError(err)
+	}
+	return loadError(ioutil.WriteFile(path, append(data, '\n'), 0644))
+}
+
+// applyLockfile pins the expected services images to the digests of the stack
+// lockfile. Services whose lock is missing or stale keep their floating tag
+// and a warning is returned for each of them.
+func applyLockfile(stack Stack, services Services) []string {
+	warnings := []string{}
+	if stack.Lock == nil {
+		return warnings
+	}
+
+	for _, name := range stack.Bundle.Keys() {
+		bundleService := stack.Bundle.Services[name]
+		locked, found := stack.Lock.Services[name]
+		if !found {
+			warnings = append(warnings, fmt.Sprintf("service %s is not in lockfile %s, run \"whaleprint lock\"", name, GetLockfileName(stack.File)))
+			continue
+		}
+		if locked.Image != bundleService.Image {
+			warnings = append(warnings, fmt.Sprintf("lockfile %s is stale for service %s (%s => %s), run \"whaleprint lock\"", GetLockfileName(stack.File), name, locked.Image, bundleService.Image))
+			continue
+		}
+
+		serviceName := GetServiceName(stack.Name, name, bundleService)
+		if service, found := services[serviceName]; found {
+			service.Spec.TaskTemplate.ContainerSpec.Image = locked.Pinned()
+			services[serviceName] = service
+		}
+	}
+	return warnings
+}
+
+// LockStack returns the lockfile of the stack with the digests of the images
+// which aren't locked yet, or whose image changed, resolved. Locked images of
+// target services, by DAB or full name and every service if there are no
+// targets, are resolved again when update is set. It also returns the names of the services whose digest
+// changed.
+func LockStack(ctx context.Context, resolver ImageResolver, stack Stack, update bool, targetMap map[string]bool) (*Lockfile, []string, error) {
+	lockFile := &Lockfile{Version: "0.1", Services: map[string]LockedImage{}}
+	if stack.Lock != nil {
+		lockFile.Version = stack.Lock.Version
+		for name, locked := range stack.Lock.Services {
+			lockFile.Services[name] = locked
+		}
+	}
+
+	changed := []string{}
+	for _, name := range stack.Bundle.Keys() {
+		image := stack.Bundle.Services[name].Image
+		locked, found := lockFile.Services[name]
+
+		// Only process found target services
+		isTarget := targetMap[name] || targetMap[GetServiceName(stack.Name, name, stack.Bundle.Services[name])]
+		if found && locked.Image == image && !(update && (len(targetMap) == 0 || isTarget)) {
+			continue
+		}
+
+		digest, err := getImageDigest(ctx, resolver, image)
+		if err != nil {
+			return nil, nil, wrapErrorf(APIError, err, "Error resolving image %s for service %s: %s", image, name, err)
+		}
+
+		if !found || locked.Digest != digest {
+			changed = append(changed, name)
+		}
+		lockFile.Services[name] = LockedImage{Image: image, Digest: digest}
+	}
+
+	// Forget services which are no longer in the bundle
+	for name := range lockFile.Services {
+		if _, found := stack.Bundle.Services[name]; !found {
+			delete(lockFile.Services, name)
+		}
+	}
+
+	return lockFile, changed, nil
+}
+
+// getImageDigest returns the digest of the image, querying the registry when
+// it isn't already pinned in the reference.
+func getImageDigest(ctx context.Context, resolver ImageResolver, image string) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", validationErrorf("Invalid image reference %s: %s", image, err)
+	}
+	if digested, ok := ref.(reference.Digested); ok {
+		return digested.Digest().String(), nil
+	}
+	return resolver.ResolveDigest(ctx, image)
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+)
+
+// objectPlanner plans the secrets or the configs of a stack bundle, which are
+// planned the same way: external objects must already exist and the content
+// of the managed ones decides whether an existing object can be used.
+type objectPlanner interface {
+	// kind is "secret" or "config"
+	kind() string
+	names() []string
+	isExternal(name string) bool
+	// planExternal looks up the external object and returns its ID
+	planExternal(ctx context.Context, cli client.APIClient, name string) (string, error)
+	read(name string) ([]byte, error)
+	// planManaged plans the object for its content and returns the ID of the
+	// existing object with the same content, empty if it must be created
+	planManaged(name string, data []byte, hash string) (string, error)
+}
+
+// planObjects plans every object of the planner in name order and returns the
+// IDs of the existing objects which are still used
+func planObjects(ctx context.Context, cli client.APIClient, planner objectPlanner) (map[string]bool, error) {
+	used := map[string]bool{}
+	for _, name := range planner.names() {
+		if planner.isExternal(name) {
+			id, err := planner.planExternal(ctx, cli, name)
+			if err != nil {
+				return nil, err
+			}
+			used[id] = true
+			continue
+		}
+
+		data, err := planner.read(name)
+		if err != nil {
+			return nil, wrapErrorf(LoadError, err, "Error reading %s %s: %s", planner.kind(), name, err)
+		}
+		sum := sha256.Sum256(data)
+
+		id, err := planner.planManaged(name, data, hex.EncodeToString(sum[:]))
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			used[id] = true
+		}
+	}
+	return used, nil
+}
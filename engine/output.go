@@ -0,0 +1,260 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+)
+
+// ServiceOutput is the live state of a stack service
+type ServiceOutput struct {
+	Stack      string
+	Service    swarm.Service
+	Tasks      []swarm.Task
+	Running    uint64
+	Desired    uint64
+	Nodes      []string
+	VirtualIPs map[string]string
+	// Digest is the image digest the running tasks use, space separated if
+	// they use several
+	Digest string
+	URLs   []string
+}
+
+// OutputData is the data the bundle outputs templates are executed with
+type OutputData struct {
+	Stack   string
+	Ingress string
+}
+
+// EvaluateOutputs executes the output templates of the stack bundle with the
+// live state of its services. It returns the values of the outputs computed
+// and the errors of the others by output name.
+func EvaluateOutputs(stack Stack, services []ServiceOutput, ingressHost string) (map[string]string, map[string]error) {
+	values := map[string]string{}
+	errs := map[string]error{}
+	for name := range stack.Bundle.Outputs {
+		value, err := EvaluateOutput(stack, services, ingressHost, name)
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		values[name] = value
+	}
+	return values, errs
+}
+
+// EvaluateOutput executes the template of a single output of the stack bundle
+func EvaluateOutput(stack Stack, services []ServiceOutput, ingressHost, name string) (string, error) {
+	live := map[string]swarm.Service{}
+	for _, o := range services {
+		live[o.Service.Spec.Name] = o.Service
+	}
+
+	getService := func(serviceName string) (swarm.Service, error) {
+		if service, found := live[GetServiceName(stack.Name, serviceName, stack.Bundle.Services[serviceName])]; found {
+			return service, nil
+		}
+		return swarm.Service{}, fmt.Errorf("service %s of stack %s is not running", serviceName, stack.Name)
+	}
+
+	funcs := template.FuncMap{
+		"service": getService,
+		// port returns the port the target port of the service is published at
+		"port": func(serviceName string, target uint32) (uint32, error) {
+			service, err := getService(serviceName)
+			if err != nil {
+				return 0, err
+			}
+			for _, port := range service.Endpoint.Ports {
+				if port.TargetPort == target && port.PublishedPort != 0 {
+					return port.PublishedPort, nil
+				}
+			}
+			return 0, fmt.Errorf("port %d of service %s is not published", target, serviceName)
+		},
+	}
+
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(stack.Bundle.Outputs[name])
+	if err != nil {
+		return "", validationErrorf("Invalid output %s: %s", name, err)
+	}
+
+	var value bytes.Buffer
+	if err := tmpl.Execute(&value, OutputData{Stack: stack.Name, Ingress: ingressHost}); err != nil {
+		return "", validationErrorf("Error computing output %s: %s", name, err)
+	}
+	return value.String(), nil
+}
+
+// OutputCollector gathers the live state of the services of stacks. Published
+// port URLs are built with IngressHost.
+type OutputCollector struct {
+	IngressHost string
+	ctx         context.Context
+	cli         client.APIClient
+	nodes       map[string]string
+	networks    map[string]string
+}
+
+// NewOutputCollector returns a collector for the swarm, which looks up the
+// node and network names once
+func NewOutputCollector(ctx context.Context, cli client.APIClient, ingressHost string) (*OutputCollector, error) {
+	o := &OutputCollector{
+		IngressHost: ingressHost,
+		ctx:         ctx,
+		cli:         cli,
+		nodes:       map[string]string{},
+		networks:    map[string]string{},
+	}
+
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, apiError(err)
+	}
+	for _, node := range nodes {
+		o.nodes[node.ID] = node.Description.Hostname
+	}
+
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return nil, apiError(err)
+	}
+	for _, network := range networks {
+		o.networks[network.ID] = network.Name
+	}
+
+	return o, nil
+}
+
+// GetStackOutputs returns the state of the stack services sorted by name
+func (o *OutputCollector) GetStackOutputs(stackName string) ([]ServiceOutput, error) {
+	filter := filters.NewArgs()
+	filter.Add("label", "com.docker.stack.namespace="+stackName)
+	services, err := o.cli.ServiceList(o.ctx, types.ServiceListOptions{Filters: filter})
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	current := GetSwarmServicesSpecForStack(services)
+
+	outputs := []ServiceOutput{}
+	for _, name := range current.Keys() {
+		output, err := o.getServiceOutput(current[name])
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+func (o *OutputCollector) getServiceOutput(s swarm.Service) (ServiceOutput, error) {
+	output := ServiceOutput{Stack: s.Spec.Labels["com.docker.stack.namespace"], Service: s, VirtualIPs: map[string]string{}}
+
+	filter := filters.NewArgs()
+	filter.Add("service", s.ID)
+	tasks, err := o.cli.TaskList(o.ctx, types.TaskListOptions{Filters: filter})
+	if err != nil {
+		return output, apiError(err)
+	}
+	output.Tasks = tasks
+
+	nodes := map[string]int{}
+	digests := map[string]bool{}
+	for _, task := range tasks {
+		if task.DesiredState != swarm.TaskStateRunning {
+			continue
+		}
+		if s.Spec.Mode.Global != nil {
+			output.Desired++
+		}
+		if task.Status.State == swarm.TaskStateRunning {
+			output.Running++
+			nodes[o.getNodeName(task.NodeID)]++
+			// Tasks run the digest resolved when they were scheduled
+			if _, _, digest, err := splitImage(task.Spec.ContainerSpec.Image); err == nil && digest != "" {
+				digests[digest] = true
+			}
+		}
+	}
+	if s.Spec.Mode.Replicated != nil && s.Spec.Mode.Replicated.Replicas != nil {
+		output.Desired = *s.Spec.Mode.Replicated.Replicas
+	}
+
+	for _, name := range SortedKeys(nodes) {
+		if nodes[name] > 1 {
+			name = fmt.Sprintf("%s (%d)", name, nodes[name])
+		}
+		output.Nodes = append(output.Nodes, name)
+	}
+
+	for _, vip := range s.Endpoint.VirtualIPs {
+		network, found := o.networks[vip.NetworkID]
+		if !found {
+			network = vip.NetworkID
+		}
+		output.VirtualIPs[network] = vip.Addr
+	}
+
+	// Tasks of a rolling update may run different digests
+	output.Digest = strings.Join(SortedKeys(digests), " ")
+
+	for _, port := range s.Endpoint.Ports {
+		output.URLs = append(output.URLs, o.getPortURL(port, SortedKeys(nodes)))
+	}
+
+	return output, nil
+}
+
+func (o *OutputCollector) getNodeName(id string) string {
+	if name, found := o.nodes[id]; found {
+		return name
+	}
+	return id
+}
+
+// getPortURL returns the URL the port is reachable at. Ports published in
+// host mode are only reachable on the nodes running the service tasks.
+func (o *OutputCollector) getPortURL(port swarm.PortConfig, nodes []string) string {
+	if port.PublishedPort == 0 {
+		return ""
+	}
+
+	scheme := "http"
+	if port.Protocol != "" && port.Protocol != swarm.PortConfigProtocolTCP {
+		scheme = string(port.Protocol)
+	}
+
+	hosts := []string{o.IngressHost}
+	if port.PublishMode == swarm.PortConfigPublishModeHost {
+		hosts = nodes
+	}
+
+	urls := make([]string, len(hosts))
+	for i, host := range hosts {
+		urls[i] = fmt.Sprintf("%s://%s:%d", scheme, host, port.PublishedPort)
+	}
+	return strings.Join(urls, " ")
+}
+
+// GetIngressHost returns the host the routing mesh is reached at, which
+// defaults to the DOCKER_HOST one
+func GetIngressHost(host string) string {
+	if host != "" {
+		return host
+	}
+	if u, err := url.Parse(os.Getenv("DOCKER_HOST")); err == nil && u.Scheme == "tcp" && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "localhost"
+}
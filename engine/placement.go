@@ -0,0 +1,235 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// constraint is a parsed placement constraint expression like
+// "node.labels.disk == ssd"
+type constraint struct {
+	key      string
+	equal    bool
+	value    string
+	original string
+}
+
+func parseConstraint(expression string) (constraint, error) {
+	for _, operator := range []string{"==", "!="} {
+		if parts := strings.SplitN(expression, operator, 2); len(parts) == 2 {
+			c := constraint{
+				key:      strings.TrimSpace(parts[0]),
+				equal:    operator == "==",
+				value:    strings.TrimSpace(parts[1]),
+				original: expression,
+			}
+			if c.key == "" || c.value == "" {
+				break
+			}
+			if _, _, err := getNodeAttribute(c.key, swarm.Node{}); err != nil {
+				return constraint{}, fmt.Errorf("invalid constraint \"%s\": %s", expression, err)
+			}
+			return c, nil
+		}
+	}
+	return constraint{}, fmt.Errorf("invalid constraint \"%s\"", expression)
+}
+
+// match evaluates the constraint against the node
+func (c constraint) match(node swarm.Node) bool {
+	value, found, _ := getNodeAttribute(c.key, node)
+	if c.equal {
+		return found && strings.EqualFold(value, c.value)
+	}
+	return !found || !strings.EqualFold(value, c.value)
+}
+
+// getNodeAttribute returns the value of a constraint key like "node.role" or
+// "node.labels.disk" for the node. Unknown keys are reported as errors.
+func getNodeAttribute(key string, node swarm.Node) (string, bool, error) {
+	var labels map[string]string
+	switch {
+	case key == "node.id":
+		return node.ID, true, nil
+	case key == "node.hostname":
+		return node.Description.Hostname, true, nil
+	case key == "node.role":
+		return string(node.Spec.Role), true, nil
+	case key == "node.platform.os":
+		return node.Description.Platform.OS, true, nil
+	case key == "node.platform.arch":
+		return node.Description.Platform.Architecture, true, nil
+	case strings.HasPrefix(key, "node.labels."):
+		labels = node.Spec.Labels
+		key = strings.TrimPrefix(key, "node.labels.")
+	case strings.HasPrefix(key, "engine.labels."):
+		labels = node.Description.Engine.Labels
+		key = strings.TrimPrefix(key, "engine.labels.")
+	default:
+		return "", false, fmt.Errorf("unknown attribute \"%s\"", key)
+	}
+
+	if key == "" {
+		return "", false, fmt.Errorf("missing label name")
+	}
+	value, found := labels[key]
+	return value, found, nil
+}
+
+func matchPlatforms(platforms []swarm.Platform, node swarm.Node) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	for _, p := range platforms {
+		if (p.Architecture == "" || p.Architecture == node.Description.Platform.Architecture) &&
+			(p.OS == "" || p.OS == node.Description.Platform.OS) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlacementCheck is the result of evaluating the placement of a service
+// against the swarm nodes. Only active nodes which are ready are eligible.
+// Constrained is set when the placement of the service restricts the nodes
+// its tasks can run on.
+type PlacementCheck struct {
+	Service     string
+	Eligible    int
+	Nodes       int
+	Constrained bool
+	Errors      []string
+	Warnings    []string
+}
+
+// CheckPlacement evaluates the placement of the services against the swarm
+// nodes. Services with errors can't be scheduled.
+func CheckPlacement(nodes []swarm.Node, services Services) []PlacementCheck {
+	checks := []PlacementCheck{}
+
+	for _, n := range services.Keys() {
+		spec := services[n].Spec
+		placement := spec.TaskTemplate.Placement
+		if placement == nil {
+			placement = &swarm.Placement{}
+		}
+		check := PlacementCheck{Service: n, Nodes: len(nodes)}
+
+		constraints := []constraint{}
+		for _, expression := range placement.Constraints {
+			c, err := parseConstraint(expression)
+			if err != nil {
+				check.Errors = append(check.Errors, err.Error())
+				continue
+			}
+			constraints = append(constraints, c)
+		}
+		for _, pref := range placement.Preferences {
+			if pref.Spread == nil {
+				continue
+			}
+			if _, _, err := getNodeAttribute(pref.Spread.SpreadDescriptor, swarm.Node{}); err != nil {
+				check.Errors = append(check.Errors, fmt.Sprintf("invalid spread preference \"%s\": %s", pref.Spread.SpreadDescriptor, err))
+			}
+		}
+		if len(check.Errors) > 0 {
+			checks = append(checks, check)
+			continue
+		}
+
+		eligible := []swarm.Node{}
+		for _, node := range nodes {
+			// Drained, paused and down nodes don't get new tasks
+			if node.Spec.Availability != swarm.NodeAvailabilityActive || node.Status.State != swarm.NodeStateReady {
+				continue
+			}
+
+			matches := matchPlatforms(placement.Platforms, node)
+			for _, c := range constraints {
+				if !c.match(node) {
+					matches = false
+				}
+			}
+			if matches {
+				eligible = append(eligible, node)
+			}
+		}
+
+		hostPorts := hasHostModePorts(spec)
+		check.Eligible = len(eligible)
+		check.Constrained = len(constraints) > 0 || len(placement.Platforms) > 0 || hostPorts
+
+		if len(eligible) == 0 {
+			check.Errors = append(check.Errors, "placement matches no nodes")
+			for _, c := range constraints {
+				if !matchesAnyNode(c, nodes) {
+					check.Errors = append(check.Errors, fmt.Sprintf("constraint \"%s\" doesn't match any node", c.original))
+				}
+			}
+			if len(placement.Platforms) > 0 {
+				check.Errors = append(check.Errors, fmt.Sprintf("platforms %v", placement.Platforms))
+			}
+			checks = append(checks, check)
+			continue
+		}
+
+		if spec.Mode.Replicated != nil && spec.Mode.Replicated.Replicas != nil {
+			replicas := *spec.Mode.Replicated.Replicas
+			perNode := placement.MaxReplicas
+			if hostPorts && (perNode == 0 || perNode > 1) {
+				perNode = 1
+			}
+
+			if perNode > 0 && replicas > uint64(len(eligible))*perNode {
+				if hostPorts {
+					check.Errors = append(check.Errors, fmt.Sprintf("%d replicas but only %d eligible nodes, ports published in host mode allow a single task per node", replicas, len(eligible)))
+				} else {
+					check.Errors = append(check.Errors, fmt.Sprintf("%d replicas but only %d eligible nodes with a maximum of %d replicas per node", replicas, len(eligible), perNode))
+				}
+			}
+		}
+
+		for _, pref := range placement.Preferences {
+			if pref.Spread != nil && !hasLabel(pref.Spread.SpreadDescriptor, eligible) {
+				check.Warnings = append(check.Warnings, fmt.Sprintf("no eligible node has label %s to spread over", pref.Spread.SpreadDescriptor))
+			}
+		}
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+func hasHostModePorts(spec swarm.ServiceSpec) bool {
+	if spec.EndpointSpec == nil {
+		return false
+	}
+	for _, port := range spec.EndpointSpec.Ports {
+		if port.PublishMode == swarm.PortConfigPublishModeHost && port.PublishedPort != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyNode(c constraint, nodes []swarm.Node) bool {
+	for _, node := range nodes {
+		if c.match(node) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLabel tells whether any of the nodes has the attribute, which must be a
+// valid one
+func hasLabel(key string, nodes []swarm.Node) bool {
+	for _, node := range nodes {
+		if _, found, _ := getNodeAttribute(key, node); found {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+)
+
+// StackPlan holds the expected and current services of a stack. Warnings are
+// the problems found while planning which don't prevent applying it.
+type StackPlan struct {
+	Stack         Stack
+	Expected      Services
+	Current       Services
+	Secrets       map[string]*SecretPlan
+	UnusedSecrets []swarm.Secret
+	Configs       map[string]*ConfigPlan
+	UnusedConfigs []swarm.Config
+	Warnings      []string
+}
+
+// GetStackPlan compares the services of the stack bundle with the ones
+// running in the swarm. Image tags are pinned to their digests with the
+// resolver, if any.
+func GetStackPlan(ctx context.Context, cli client.APIClient, stack Stack, resolver ImageResolver) (*StackPlan, error) {
+	filter := filters.NewArgs()
+	filter.Add("label", "com.docker.stack.namespace="+stack.Name)
+	services, servicesErr := cli.ServiceList(ctx, types.ServiceListOptions{Filters: filter})
+	if servicesErr != nil {
+		return nil, apiError(servicesErr)
+	}
+
+	// Only the planned services need the values of the placeholders
+	bundle, err := interpolateEnv(stack.Bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := GetBundleServicesSpec(bundle, stack.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := TranslateNetworkToIds(ctx, cli, expected, stack.Name); err != nil {
+		return nil, err
+	}
+
+	warnings := append(checkLogDrivers(stack), applyLockfile(stack, expected)...)
+
+	if resolver != nil {
+		warnings = append(warnings, resolveImages(ctx, resolver, expected)...)
+	}
+
+	secrets, unusedSecrets, err := planSecrets(ctx, cli, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applySecretReferences(stack, expected, secrets); err != nil {
+		return nil, err
+	}
+
+	configs, unusedConfigs, err := planConfigs(ctx, cli, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyConfigReferences(stack, expected, configs); err != nil {
+		return nil, err
+	}
+
+	current := GetSwarmServicesSpecForStack(services)
+	keepImportedLabels(current, expected)
+
+	return &StackPlan{
+		Stack:         stack,
+		Expected:      expected,
+		Current:       current,
+		Secrets:       secrets,
+		UnusedSecrets: unusedSecrets,
+		Configs:       configs,
+		UnusedConfigs: unusedConfigs,
+		Warnings:      warnings,
+	}, nil
+}
+
+// Print writes the plan with the service printer and returns the number of
+// changes found and how many of them are removals of protected services.
+func (p *StackPlan) Print(sp *ServicePrinter, targetMap, allowDestroy map[string]bool) (changes, protectedRemovals int, err error) {
+	w := sp.w
+	green := color.New(color.FgGreen)
+	red := color.New(color.FgRed)
+
+	// Secret contents are never printed, only their names
+	for _, n := range SortedKeys(p.Secrets) {
+		if secret := p.Secrets[n]; secret.ID == "" {
+			changes++
+			green.Fprintf(w, "+ secret %s\n", secret.Spec.Name)
+			fmt.Fprintln(w)
+		}
+	}
+
+	for _, secret := range p.UnusedSecrets {
+		changes++
+		red.Fprintf(w, "- secret %s\n", secret.Spec.Name)
+		fmt.Fprintln(w)
+	}
+
+	for _, n := range SortedKeys(p.Configs) {
+		if config := p.Configs[n]; config.ID == "" {
+			changes++
+			green.Fprintf(w, "+ config %s\n", config.Spec.Name)
+			printContentDiff(w, config.Previous, config.Spec.Data)
+			fmt.Fprintln(w)
+		}
+	}
+
+	for _, config := range p.UnusedConfigs {
+		changes++
+		red.Fprintf(w, "- config %s\n", config.Spec.Name)
+		fmt.Fprintln(w)
+	}
+
+	for _, n := range p.Expected.Keys() {
+		es := p.Expected[n]
+		// Only process found target services
+		if _, found := targetMap[es.Spec.Name]; len(targetMap) == 0 || found {
+			if cs, found := p.Current[n]; !found {
+				// New service to create
+				changes++
+				green.Fprintf(w, "+ %s\n", n)
+				sp.PrintServiceSpec(es.Spec)
+				fmt.Fprintln(w)
+			} else {
+				// The differences are printed after the service name
+				diff := NewServicePrinter(ioutil.Discard, sp.detail, sp.redactor)
+				different, err := diff.PrintServiceSpecDiff(cs.Spec, es.Spec)
+				if err != nil {
+					return changes, protectedRemovals, err
+				}
+
+				if different {
+					changes++
+					color.New(color.FgYellow).Fprintf(w, "~ %s\n", es.Spec.Name)
+				} else if sp.detail {
+					color.New(color.FgCyan).Fprintf(w, "%s\n", es.Spec.Name)
+				}
+
+				if different || sp.detail {
+					sp.PrintServiceSpecDiff(cs.Spec, es.Spec)
+					fmt.Fprintln(w)
+				}
+			}
+		}
+	}
+
+	// Checks services to remove
+	for _, n := range p.Current.Keys() {
+		cs := p.Current[n]
+		// Only process found target services
+		if _, found := targetMap[cs.Spec.Name]; len(targetMap) == 0 || found {
+			if _, found := p.Expected[n]; !found {
+				changes++
+				if IsProtected(cs) && !isDestroyAllowed(allowDestroy, p.Stack.Name, n) {
+					protectedRemovals++
+					red.Fprintf(w, "- %s (error: service is protected from being destroyed)\n", n)
+				} else {
+					red.Fprintf(w, "- %s\n", n)
+				}
+				sp.PrintServiceSpec(cs.Spec)
+				fmt.Fprintln(w)
+			}
+		}
+
+	}
+
+	return changes, protectedRemovals, nil
+}
+
+// Change is a planned change of a stack object. Kind is "service", "secret"
+// or "config" and Action is "create", "update", "remove" or "none".
+type Change struct {
+	Stack     string
+	Kind      string
+	Name      string
+	Action    string
+	Protected bool
+	Current   *swarm.Service
+	Expected  *swarm.Service
+	Diff      []DiffRecord
+}
+
+// Changes returns the changes of the plan, services which don't change
+// included. Environment values in the services and the differences are
+// masked with the redactor.
+func (p *StackPlan) Changes(redactor *Redactor, targetMap, allowDestroy map[string]bool) ([]Change, error) {
+	changes := []Change{}
+	sp := NewServicePrinter(ioutil.Discard, false, redactor)
+
+	for _, n := range SortedKeys(p.Secrets) {
+		if secret := p.Secrets[n]; secret.ID == "" {
+			changes = append(changes, Change{Stack: p.Stack.Name, Kind: "secret", Name: secret.Spec.Name, Action: "create"})
+		}
+	}
+	for _, secret := range p.UnusedSecrets {
+		changes = append(changes, Change{Stack: p.Stack.Name, Kind: "secret", Name: secret.Spec.Name, Action: "remove"})
+	}
+	for _, n := range SortedKeys(p.Configs) {
+		if config := p.Configs[n]; config.ID == "" {
+			changes = append(changes, Change{Stack: p.Stack.Name, Kind: "config", Name: config.Spec.Name, Action: "create"})
+		}
+	}
+	for _, config := range p.UnusedConfigs {
+		changes = append(changes, Change{Stack: p.Stack.Name, Kind: "config", Name: config.Spec.Name, Action: "remove"})
+	}
+
+	for _, n := range p.Expected.Keys() {
+		es := p.Expected[n]
+		if _, found := targetMap[n]; len(targetMap) > 0 && !found {
+			continue
+		}
+
+		change := Change{Stack: p.Stack.Name, Kind: "service", Name: n, Action: "create", Expected: maskEnv(es, sp.redactor)}
+		if cs, found := p.Current[n]; found {
+			change.Current = maskEnv(cs, sp.redactor)
+			change.Action = "none"
+			different, err := sp.PrintServiceSpecDiff(cs.Spec, es.Spec)
+			if err != nil {
+				return nil, err
+			}
+			if different {
+				change.Action = "update"
+				change.Diff = sp.Records()
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	for _, n := range p.Current.Keys() {
+		cs := p.Current[n]
+		if _, found := targetMap[n]; len(targetMap) > 0 && !found {
+			continue
+		}
+		if _, found := p.Expected[n]; !found {
+			changes = append(changes, Change{
+				Stack:     p.Stack.Name,
+				Kind:      "service",
+				Name:      n,
+				Action:    "remove",
+				Protected: IsProtected(cs) && !isDestroyAllowed(allowDestroy, p.Stack.Name, n),
+				Current:   maskEnv(cs, sp.redactor),
+			})
+		}
+	}
+
+	return changes, nil
+}
+
+// maskEnv returns a copy of the service with the sensitive environment values
+// masked, since changes are printed with templates
+func maskEnv(s swarm.Service, r *Redactor) *swarm.Service {
+	env := s.Spec.TaskTemplate.ContainerSpec.Env
+	if len(env) > 0 {
+		masked := make([]string, len(env))
+		for i, entry := range env {
+			masked[i] = r.Mask(entry)
+		}
+		s.Spec.TaskTemplate.ContainerSpec.Env = masked
+	}
+	return &s
+}
@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// getIngressPorts returns the ports published through the routing mesh by the
+// service keyed by "<port>/<protocol>"
+func getIngressPorts(service swarm.Service) []string {
+	ports := []swarm.PortConfig{}
+	if service.Spec.EndpointSpec != nil {
+		ports = append(ports, service.Spec.EndpointSpec.Ports...)
+	}
+	ports = append(ports, service.Endpoint.Ports...)
+
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, port := range ports {
+		if port.PublishedPort == 0 || port.PublishMode == swarm.PortConfigPublishModeHost {
+			continue
+		}
+
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = swarm.PortConfigProtocolTCP
+		}
+
+		key := fmt.Sprintf("%d/%s", port.PublishedPort, protocol)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// PortConflict is an ingress port, like "80/tcp", published by a planned
+// service and by Owner. Live is set when Owner is a service running outside
+// the planned stacks.
+type PortConflict struct {
+	Port    string
+	Service string
+	Owner   string
+	Live    bool
+}
+
+func (c PortConflict) String() string {
+	if c.Live {
+		return fmt.Sprintf("port %s of %s is already published by %s", c.Port, c.Service, c.Owner)
+	}
+	return fmt.Sprintf("port %s of %s is also published by %s", c.Port, c.Service, c.Owner)
+}
+
+// CheckPortConflicts looks for ingress published ports claimed by more than one
+// service among the planned stacks and every service running in the swarm.
+func CheckPortConflicts(live []swarm.Service, plans []*StackPlan) []PortConflict {
+	owners := map[string]string{}
+	conflicts := []PortConflict{}
+
+	// Services of the planned stacks are either expected or going to be removed
+	planned := map[string]bool{}
+	for _, p := range plans {
+		for name := range p.Current {
+			planned[name] = true
+		}
+		for name := range p.Expected {
+			planned[name] = true
+		}
+	}
+
+	for _, p := range plans {
+		for _, n := range p.Expected.Keys() {
+			for _, key := range getIngressPorts(p.Expected[n]) {
+				if owner, found := owners[key]; found && owner != n {
+					conflicts = append(conflicts, PortConflict{Port: key, Service: n, Owner: owner})
+					continue
+				}
+				owners[key] = n
+			}
+		}
+	}
+
+	sort.Slice(live, func(i, j int) bool { return live[i].Spec.Name < live[j].Spec.Name })
+	for _, service := range live {
+		if planned[service.Spec.Name] {
+			continue
+		}
+		for _, key := range getIngressPorts(service) {
+			if owner, found := owners[key]; found {
+				conflicts = append(conflicts, PortConflict{Port: key, Service: owner, Owner: service.Spec.Name, Live: true})
+			}
+		}
+	}
+
+	return conflicts
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const envNamespace = ".TaskTemplate.ContainerSpec.Env"
+
+// defaultRedactPatterns match the names of environment variables which
+// usually hold credentials
+var defaultRedactPatterns = []string{
+	"(?i)(^|_)PASSW(OR)?D$",
+	"(?i)(^|_)TOKEN$",
+	"(?i)(^|_)KEY$",
+	"(?i)(^|_)SECRET$",
+}
+
+// Redactor hides the values of environment variables whose names match any
+// of its patterns
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor returns a redactor for the built-in patterns plus the given
+// regular expressions
+func NewRedactor(patterns []string) (*Redactor, error) {
+	r := &Redactor{}
+	all := append(append([]string{}, defaultRedactPatterns...), patterns...)
+	for _, pattern := range all {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, validationErrorf("Invalid redact pattern \"%s\": %s", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// DefaultRedactor returns a redactor for the built-in patterns only
+func DefaultRedactor() *Redactor {
+	r, _ := NewRedactor(nil)
+	return r
+}
+
+func (r *Redactor) matches(name string) bool {
+	for _, re := range r.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact replaces the values of the sensitive variables of env with ${VAR}
+// placeholders. It returns the redacted environment and the names of the
+// placeholders introduced.
+func (r *Redactor) Redact(env []string) ([]string, []string) {
+	if len(env) == 0 {
+		return env, nil
+	}
+
+	redacted := make([]string, len(env))
+	placeholders := []string{}
+	for i, entry := range env {
+		name, _ := splitEnv(entry)
+		if r.matches(name) {
+			redacted[i] = fmt.Sprintf("%s=${%s}", name, name)
+			placeholders = append(placeholders, name)
+			continue
+		}
+		redacted[i] = entry
+	}
+	return redacted, placeholders
+}
+
+// Mask hides the value of the environment entry if it's sensitive
+func (r *Redactor) Mask(entry string) string {
+	name, _ := splitEnv(entry)
+	if !r.matches(name) {
+		return entry
+	}
+	return fmt.Sprintf("%s=%s", name, sensitiveValue)
+}
+
+// RedactBundle returns a copy of the bundle with the sensitive environment
+// variables of its services replaced by placeholders, along with the sorted
+// placeholder names.
+func RedactBundle(bundle *Bundlefile, r *Redactor) (*Bundlefile, []string) {
+	redacted := *bundle
+	redacted.Services = map[string]Service{}
+
+	seen := map[string]bool{}
+	placeholders := []string{}
+	for name, service := range bundle.Services {
+		env, names := r.Redact(service.Env)
+		service.Env = env
+		redacted.Services[name] = service
+
+		for _, n := range names {
+			if !seen[n] {
+				seen[n] = true
+				placeholders = append(placeholders, n)
+			}
+		}
+	}
+	sort.Strings(placeholders)
+	return &redacted, placeholders
+}
+
+// interpolateEnv returns a copy of the bundle whose NAME=${NAME} environment
+// entries, the placeholders export writes for redacted values, have the values
+// of the local environment. Other values are never rewritten so they reach
+// the containers as written.
+func interpolateEnv(bundle *Bundlefile) (*Bundlefile, error) {
+	interpolated := *bundle
+	interpolated.Services = map[string]Service{}
+
+	missing := []string{}
+	seen := map[string]bool{}
+	for key, service := range bundle.Services {
+		if len(service.Env) > 0 {
+			env := make([]string, len(service.Env))
+			for i, entry := range service.Env {
+				env[i] = entry
+				name, value := splitEnv(entry)
+				if value != fmt.Sprintf("${%s}", name) {
+					continue
+				}
+
+				local, found := os.LookupEnv(name)
+				if !found && !seen[name] {
+					seen[name] = true
+					missing = append(missing, name)
+				}
+				env[i] = fmt.Sprintf("%s=%s", name, local)
+			}
+			service.Env = env
+		}
+		interpolated.Services[key] = service
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, validationErrorf("Environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return &interpolated, nil
+}
+
+func splitEnv(entry string) (string, string) {
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	defaultIndexServer = "https://index.docker.io/v1/"
+	// authConfigEnv allows to supply the docker config file contents through
+	// the environment, which is handy for CI systems
+	authConfigEnv = "DOCKER_AUTH_CONFIG"
+)
+
+// dockerConfig holds the registry credentials of the docker config file
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// RegistryAuth resolves the credentials to use for each image registry
+type RegistryAuth struct {
+	config *dockerConfig
+	cache  map[string]string
+}
+
+// NewRegistryAuth loads the registry credentials from the DOCKER_AUTH_CONFIG
+// environment variable or, if it's not set, from the docker config file.
+func NewRegistryAuth() (*RegistryAuth, error) {
+	config := &dockerConfig{}
+
+	if env := os.Getenv(authConfigEnv); env != "" {
+		if err := json.Unmarshal([]byte(env), config); err != nil {
+			return nil, loadErrorf("Error parsing %s: %s", authConfigEnv, err)
+		}
+	} else {
+		data, err := ioutil.ReadFile(getDockerConfigFile())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, loadErrorf("Error reading docker config file: %s", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, config); err != nil {
+				return nil, loadErrorf("Error parsing docker config file: %s", err)
+			}
+		}
+	}
+
+	return &RegistryAuth{config: config, cache: map[string]string{}}, nil
+}
+
+func getDockerConfigFile() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			home = os.Getenv("USERPROFILE")
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// EncodedAuth returns the base64 encoded credentials for the registry of the
+// specified image as expected by the docker API.
+func (ra *RegistryAuth) EncodedAuth(image string) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", validationErrorf("Invalid image reference %s: %s", image, err)
+	}
+
+	server := reference.Domain(ref)
+	if server == "docker.io" {
+		server = defaultIndexServer
+	}
+
+	if encoded, found := ra.cache[server]; found {
+		return encoded, nil
+	}
+
+	auth, err := ra.getAuthConfig(server)
+	if err != nil {
+		return "", err
+	}
+
+	buf, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.URLEncoding.EncodeToString(buf)
+	ra.cache[server] = encoded
+	return encoded, nil
+}
+
+func (ra *RegistryAuth) getAuthConfig(server string) (types.AuthConfig, error) {
+	helper := ra.config.CredsStore
+	if h, found := ra.config.CredHelpers[server]; found {
+		helper = h
+	}
+
+	if helper != "" {
+		return getHelperAuthConfig(helper, server)
+	}
+
+	for _, key := range []string{server, "https://" + server, "http://" + server} {
+		if auth, found := ra.config.Auths[key]; found {
+			return decodeAuth(server, auth)
+		}
+	}
+
+	return types.AuthConfig{ServerAddress: server}, nil
+}
+
+func decodeAuth(server string, auth dockerAuth) (types.AuthConfig, error) {
+	authConfig := types.AuthConfig{ServerAddress: server, IdentityToken: auth.IdentityToken}
+	if auth.Auth == "" {
+		return authConfig, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	if err != nil {
+		return authConfig, loadErrorf("Invalid credentials for registry %s: %s", server, err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return authConfig, loadErrorf("Invalid credentials for registry %s", server)
+	}
+
+	authConfig.Username = parts[0]
+	authConfig.Password = parts[1]
+	return authConfig, nil
+}
+
+// getHelperAuthConfig fetches the credentials from a docker credential helper
+func getHelperAuthConfig(helper, server string) (types.AuthConfig, error) {
+	authConfig := types.AuthConfig{ServerAddress: server}
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return authConfig, nil
+		}
+		return authConfig, loadErrorf("Error getting credentials for registry %s from docker-credential-%s: %s %s", server, helper, err, strings.TrimSpace(stderr.String()))
+	}
+
+	creds := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return authConfig, loadErrorf("Invalid credentials for registry %s from docker-credential-%s: %s", server, helper, err)
+	}
+
+	if creds.Username == "<token>" {
+		authConfig.IdentityToken = creds.Secret
+	} else {
+		authConfig.Username = creds.Username
+		authConfig.Password = creds.Secret
+	}
+	return authConfig, nil
+}
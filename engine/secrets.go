@@ -0,0 +1,266 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	secretLabel        = "whaleprint.secret"
+	secretHashLabel    = "whaleprint.secret.hash"
+	secretSaltLabel    = "whaleprint.secret.salt"
+	secretVersionLabel = "whaleprint.secret.version"
+)
+
+// SecretPlan is the swarm secret expected for a bundle secret. ID is empty
+// when a new secret version needs to be created.
+type SecretPlan struct {
+	Name     string
+	ID       string
+	Spec     swarm.SecretSpec
+	External bool
+}
+
+// planSecrets finds the swarm secrets matching the stack bundle secrets.
+// Managed secrets are versioned, whenever their content changes a new version
+// is planned. It also returns the stack secrets which are no longer used.
+func planSecrets(ctx context.Context, cli client.APIClient, stack Stack) (map[string]*SecretPlan, []swarm.Secret, error) {
+	filter := filters.NewArgs()
+	filter.Add("label", "com.docker.stack.namespace="+stack.Name)
+	existing, err := cli.SecretList(ctx, types.SecretListOptions{Filters: filter})
+	if err != nil {
+		return nil, nil, apiError(err)
+	}
+
+	planner := &secretPlanner{stack: stack, existing: existing, plans: map[string]*SecretPlan{}}
+	used, err := planObjects(ctx, cli, planner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unused := []swarm.Secret{}
+	for _, s := range existing {
+		if _, managed := s.Spec.Labels[secretLabel]; managed && !used[s.ID] {
+			unused = append(unused, s)
+		}
+	}
+
+	return planner.plans, unused, nil
+}
+
+// secretPlanner plans the secrets of a stack with objectPlanner
+type secretPlanner struct {
+	stack    Stack
+	existing []swarm.Secret
+	plans    map[string]*SecretPlan
+}
+
+func (p *secretPlanner) kind() string {
+	return "secret"
+}
+
+func (p *secretPlanner) names() []string {
+	return SortedKeys(p.stack.Bundle.Secrets)
+}
+
+func (p *secretPlanner) isExternal(name string) bool {
+	return p.stack.Bundle.Secrets[name].External
+}
+
+func (p *secretPlanner) planExternal(ctx context.Context, cli client.APIClient, name string) (string, error) {
+	secret := p.stack.Bundle.Secrets[name]
+	secretName := secret.Name
+	if secretName == "" {
+		secretName = name
+	}
+
+	filter := filters.NewArgs()
+	filter.Add("name", secretName)
+	secrets, err := cli.SecretList(ctx, types.SecretListOptions{Filters: filter})
+	if err != nil {
+		return "", apiError(err)
+	}
+
+	for _, s := range secrets {
+		if s.Spec.Name == secretName {
+			p.plans[name] = &SecretPlan{Name: name, ID: s.ID, Spec: s.Spec, External: true}
+			return s.ID, nil
+		}
+	}
+	return "", validationErrorf("External secret %s not found", secretName)
+}
+
+func (p *secretPlanner) read(name string) ([]byte, error) {
+	secret := p.stack.Bundle.Secrets[name]
+	return readSource(p.stack, secret.File, secret.Environment)
+}
+
+// planManaged compares the content with the salted hashes of the existing
+// versions, the plain content hash is never stored since secret labels can be
+// read by anyone with access to the swarm. Versions without salt are replaced.
+func (p *secretPlanner) planManaged(name string, data []byte, hash string) (string, error) {
+	version := 0
+	for _, s := range p.existing {
+		if s.Spec.Labels[secretLabel] != name {
+			continue
+		}
+		if v, err := strconv.Atoi(s.Spec.Labels[secretVersionLabel]); err == nil && v > version {
+			version = v
+		}
+		if salt := s.Spec.Labels[secretSaltLabel]; salt != "" && s.Spec.Labels[secretHashLabel] == saltedHash(salt, data) {
+			p.plans[name] = &SecretPlan{Name: name, ID: s.ID, Spec: s.Spec}
+			return s.ID, nil
+		}
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("Error salting secret %s: %s", name, err)
+	}
+	salt := hex.EncodeToString(random)
+
+	version++
+	p.plans[name] = &SecretPlan{
+		Name: name,
+		Spec: swarm.SecretSpec{
+			Annotations: swarm.Annotations{
+				Name: fmt.Sprintf("%s_%s_v%d", p.stack.Name, name, version),
+				Labels: map[string]string{
+					"com.docker.stack.namespace": p.stack.Name,
+					secretLabel:                  name,
+					secretHashLabel:              saltedHash(salt, data),
+					secretSaltLabel:              salt,
+					secretVersionLabel:           strconv.Itoa(version),
+				},
+			},
+			Data: data,
+		},
+	}
+	return "", nil
+}
+
+// saltedHash is the HMAC of the secret content keyed with the salt
+func saltedHash(salt string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// applySecretReferences attaches the planned secrets to the expected services
+func applySecretReferences(stack Stack, services Services, secrets map[string]*SecretPlan) error {
+	for name, bundleService := range stack.Bundle.Services {
+		serviceName := GetServiceName(stack.Name, name, bundleService)
+		service, found := services[serviceName]
+		if !found || len(bundleService.Secrets) == 0 {
+			continue
+		}
+
+		refs := []*swarm.SecretReference{}
+		for _, ref := range bundleService.Secrets {
+			plan, found := secrets[ref.Source]
+			if !found {
+				return validationErrorf("Service %s references undefined secret %s", serviceName, ref.Source)
+			}
+
+			target, err := getFileTarget(ref.Source, ref.Target, ref.UID, ref.GID, ref.Mode, 0444)
+			if err != nil {
+				return validationErrorf("Invalid secret %s for service %s: %s", ref.Source, serviceName, err)
+			}
+
+			refs = append(refs, &swarm.SecretReference{
+				File: &swarm.SecretReferenceFileTarget{
+					Name: target.Name,
+					UID:  target.UID,
+					GID:  target.GID,
+					Mode: target.Mode,
+				},
+				SecretID:   plan.ID,
+				SecretName: plan.Spec.Name,
+			})
+		}
+
+		service.Spec.TaskTemplate.ContainerSpec.Secrets = refs
+		services[serviceName] = service
+	}
+	return nil
+}
+
+type fileTarget struct {
+	Name string
+	UID  string
+	GID  string
+	Mode os.FileMode
+}
+
+func getFileTarget(source, target, uid, gid, mode string, defaultMode os.FileMode) (fileTarget, error) {
+	t := fileTarget{Name: target, UID: uid, GID: gid, Mode: defaultMode}
+	if t.Name == "" {
+		t.Name = source
+	}
+	if t.UID == "" {
+		t.UID = "0"
+	}
+	if t.GID == "" {
+		t.GID = "0"
+	}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return t, fmt.Errorf("invalid mode \"%s\"", mode)
+		}
+		t.Mode = os.FileMode(m)
+	}
+	return t, nil
+}
+
+// createSecrets creates the planned secrets which don't exist yet and updates
+// the references of the expected services with their IDs.
+func createSecrets(ctx context.Context, cli client.APIClient, secrets map[string]*SecretPlan, services Services, opts ApplyOptions) error {
+	for _, name := range SortedKeys(secrets) {
+		plan := secrets[name]
+		if plan.ID != "" {
+			continue
+		}
+
+		opts.progress("create", "secret", plan.Spec.Name)
+		resp, err := cli.SecretCreate(ctx, plan.Spec)
+		if err != nil {
+			return apiError(err)
+		}
+		opts.done()
+		plan.ID = resp.ID
+
+		for _, service := range services {
+			for _, ref := range service.Spec.TaskTemplate.ContainerSpec.Secrets {
+				if ref.SecretName == plan.Spec.Name {
+					ref.SecretID = plan.ID
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// removeSecrets removes the secrets which are no longer used by the stack.
+// Secrets still in use by services outside the plan are kept.
+func removeSecrets(ctx context.Context, cli client.APIClient, secrets []swarm.Secret, opts ApplyOptions) {
+	for _, secret := range secrets {
+		opts.progress("remove", "secret", secret.Spec.Name)
+		if err := cli.SecretRemove(ctx, secret.ID); err != nil {
+			opts.warn("unable to remove secret %s: %s", secret.Spec.Name, err)
+			continue
+		}
+		opts.done()
+	}
+}
@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Stack is a DAB loaded with the lockfile found next to it, if any
+type Stack struct {
+	Name   string
+	File   string
+	Bundle *Bundlefile
+	Lock   *Lockfile
+}
+
+// LoadStack reads the DAB file of the stack, interpolating the environment of
+// its services, and its lockfile
+func LoadStack(name, file string) (Stack, error) {
+	if u, err := url.Parse(file); err == nil && u.IsAbs() {
+		// DAB file seems to be remote, try to download it first
+		return Stack{}, loadErrorf("Not implemented")
+	}
+
+	dabReader, err := os.Open(file)
+	if err != nil {
+		return Stack{}, loadError(err)
+	}
+	defer dabReader.Close()
+
+	bundle, err := LoadBundlefile(dabReader)
+	if err != nil {
+		return Stack{}, err
+	}
+
+	lock, err := LoadLockfile(GetLockfileName(file))
+	if err != nil {
+		return Stack{}, err
+	}
+	return Stack{Name: name, File: file, Bundle: bundle, Lock: lock}, nil
+}
+
+// FindStacks returns the names of the stacks whose DAB files are in dir
+func FindStacks(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, loadError(err)
+	}
+
+	dabs := []string{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".dab") {
+			dabs = append(dabs, strings.TrimSuffix(file.Name(), ".dab"))
+		}
+	}
+	return dabs, nil
+}
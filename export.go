@@ -1,121 +1,262 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
-	"github.com/docker/docker/api/client/bundlefile"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+	"github.com/mantika/whaleprint/engine"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
 )
 
 func export(c *cli.Context) error {
+	stackNames := map[string]bool{}
+	for _, name := range c.Args() {
+		stackNames[name] = true
+	}
+
+	toStdout := c.Bool("stdout")
+	outputDir := c.String("output-dir")
+	force := c.Bool("force")
+	format := c.String("format")
+
+	if err := configureRedaction(c.StringSlice("redact")); err != nil {
+		return exitWithError(err)
+	}
+	redactor := envRedactor
+	if c.Bool("no-redact") {
+		redactor = &engine.Redactor{}
+	}
+
+	if format != "dab" && format != "compose" {
+		return cli.NewExitError(fmt.Sprintf("Unknown export format %s", format), exitInvalid)
+	}
+	if format == "compose" && c.Bool("verify") {
+		return cli.NewExitError("--verify is only supported for the dab format", exitInvalid)
+	}
+
+	// Keep stdout clean for the DAB when printing it there
+	var info io.Writer = os.Stdout
+	if toStdout {
+		info = os.Stderr
+	}
 
 	swarm, swarmErr := client.NewEnvClient()
 	if swarmErr != nil {
-		return cli.NewExitError(swarmErr.Error(), 3)
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
 	}
 
-	services, servicesErr := swarm.ServiceList(context.Background(), types.ServiceListOptions{})
-
-	if len(services) == 0 {
-		fmt.Println("No services found to export")
-		return nil
+	filter := filters.NewArgs()
+	for _, label := range c.StringSlice("label") {
+		filter.Add("label", label)
 	}
 
+	services, servicesErr := swarm.ServiceList(context.Background(), types.ServiceListOptions{Filters: filter})
 	if servicesErr != nil {
-		return cli.NewExitError(servicesErr.Error(), 3)
+		return cli.NewExitError(servicesErr.Error(), exitAPI)
 	}
 
-	bundles := map[string]*bundlefile.Bundlefile{}
-	for _, service := range services {
-		var dab *bundlefile.Bundlefile
-		stackName := getStackName(service.Spec.Labels)
+	exporter, err := engine.NewExporter(context.Background(), swarm)
+	if err != nil {
+		return exitWithError(err)
+	}
 
-		if dab = bundles[stackName]; dab == nil {
-			dab = &bundlefile.Bundlefile{Version: "0.1", Services: map[string]bundlefile.Service{}}
-			bundles[stackName] = dab
-		}
+	stacks := engine.GroupByStack(services, stackNames, c.Bool("unlabelled"))
 
-		bundleService, err := getBundleService(service)
-		if err != nil {
-			return cli.NewExitError(servicesErr.Error(), 3)
+	if len(stacks) == 0 {
+		fmt.Fprintln(info, "No services found to export")
+		return nil
+	}
+
+	if toStdout && len(stacks) > 1 {
+		return cli.NewExitError("Only one stack can be exported to stdout, specify the stack name", exitInvalid)
+	}
+
+	// Check every destination first so an existing file doesn't leave the
+	// export half written
+	if !toStdout {
+		extension := "dab"
+		if format == "compose" {
+			extension = "yml"
+		}
+		files := []string{}
+		for _, stackName := range engine.SortedKeys(stacks) {
+			files = append(files, filepath.Join(outputDir, fmt.Sprintf("%s.%s", stackName, extension)))
+		}
+		if err := engine.CheckOverwrite(files, force); err != nil {
+			return exitWithError(err)
 		}
+	}
+
+	if format == "compose" {
+		return exportCompose(exporter, redactor, stacks, info, toStdout, outputDir, force)
+	}
 
-		// Remove the stackname from the service in DAB
-		service.Spec.Name = strings.TrimPrefix(service.Spec.Name, fmt.Sprintf("%s_", stackName))
+	bundles := map[string]*engine.Bundlefile{}
+	for stackName, stackServices := range stacks {
+		dab := &engine.Bundlefile{Version: "0.1", Services: map[string]engine.Service{}}
+		bundles[stackName] = dab
 
-		dab.Services[service.Spec.Name] = *bundleService
+		for _, service := range stackServices {
+			bundleService, err := exporter.GetBundleService(service, stackName, dab)
+			if err != nil {
+				return exitWithError(err)
+			}
 
+			// Remove the stackname from the service in DAB
+			dab.Services[engine.GetBundleServiceKey(service.Spec.Name, stackName)] = *bundleService
+		}
 	}
 
 	for output, bundle := range bundles {
-		f, err := os.Create(fmt.Sprintf("%s.dab", output))
-		if err != nil {
-			return cli.NewExitError(servicesErr.Error(), 3)
-		}
+		// Bundles are verified unredacted, the local environment may not
+		// have the placeholder values
+		bundle, placeholders := engine.RedactBundle(bundle, redactor)
 
-		err = json.NewEncoder(f).Encode(bundle)
-		if err != nil {
-			return cli.NewExitError(servicesErr.Error(), 3)
+		if toStdout {
+			if err := engine.PrintBundlefile(os.Stdout, bundle); err != nil {
+				return cli.NewExitError(err.Error(), exitLoad)
+			}
+		} else {
+			file := filepath.Join(outputDir, fmt.Sprintf("%s.dab", output))
+			if err := engine.WriteBundlefile(file, bundle, force); err != nil {
+				return exitWithError(err)
+			}
 		}
 
-		fmt.Printf("Swarm services exported successfuly for stack: %s \n", output)
-		for name, _ := range bundle.Services {
-			fmt.Println(name)
+		fmt.Fprintf(info, "Swarm services exported successfuly for stack: %s \n", output)
+		for _, name := range bundle.Keys() {
+			fmt.Fprintln(info, name)
 		}
-		fmt.Println()
+		printPlaceholders(info, placeholders)
+		fmt.Fprintln(info)
+	}
+
+	if c.Bool("verify") {
+		return verifyExport(swarm, bundles)
 	}
 
 	return nil
 }
 
-func getStackName(labels map[string]string) string {
-	if stackName, ok := labels["com.docker.stack.namespace"]; ok {
-		return stackName
+// exportCompose writes a compose file per stack, listing the properties of
+// the services which couldn't be represented in it.
+func exportCompose(e *engine.Exporter, redactor *engine.Redactor, stacks map[string][]swarm.Service, info io.Writer, toStdout bool, outputDir string, force bool) error {
+	for stackName, services := range stacks {
+		compose := &engine.ComposeFile{Version: engine.ComposeVersion, Services: map[string]engine.ComposeService{}}
+		warnings := map[string][]string{}
+		seen := map[string]bool{}
+		placeholders := []string{}
+
+		for _, service := range services {
+			name := engine.GetBundleServiceKey(service.Spec.Name, stackName)
+			composeService, unsupported := e.GetComposeService(service, stackName, compose)
+
+			env, names := redactor.Redact(composeService.Environment)
+			composeService.Environment = env
+			for _, n := range names {
+				if !seen[n] {
+					seen[n] = true
+					placeholders = append(placeholders, n)
+				}
+			}
+
+			compose.Services[name] = *composeService
+			if len(unsupported) > 0 {
+				warnings[name] = unsupported
+			}
+		}
+
+		if toStdout {
+			if err := engine.PrintComposeFile(os.Stdout, compose); err != nil {
+				return cli.NewExitError(err.Error(), exitLoad)
+			}
+		} else {
+			file := filepath.Join(outputDir, fmt.Sprintf("%s.yml", stackName))
+			if err := engine.WriteComposeFile(file, compose, force); err != nil {
+				return exitWithError(err)
+			}
+		}
+
+		fmt.Fprintf(info, "Swarm services exported successfuly for stack: %s \n", stackName)
+		for _, name := range compose.Keys() {
+			fmt.Fprintln(info, name)
+		}
+		for _, name := range compose.Keys() {
+			if len(warnings[name]) > 0 {
+				yellow.Fprintf(info, "Warning: %s: can't represent %s in compose\n", name, strings.Join(warnings[name], ", "))
+			}
+		}
+		sort.Strings(placeholders)
+		printPlaceholders(info, placeholders)
+		fmt.Fprintln(info)
 	}
-	return "services"
+	return nil
+}
 
+// printPlaceholders lists the environment variables which must be set to
+// deploy the redacted services
+func printPlaceholders(w io.Writer, placeholders []string) {
+	if len(placeholders) == 0 {
+		return
+	}
+	yellow.Fprintf(w, "Redacted environment values, these variables must be set to deploy the stack:\n")
+	for _, name := range placeholders {
+		fmt.Fprintf(w, "    %s\n", name)
+	}
 }
 
-func getBundleService(service swarm.Service) (*bundlefile.Service, error) {
-	serviceBundle := &bundlefile.Service{
-		Image:         service.Spec.TaskTemplate.ContainerSpec.Image,
-		ServiceLabels: service.Spec.TaskTemplate.ContainerSpec.Labels,
-		Labels:        service.Spec.Labels,
-		Command:       service.Spec.TaskTemplate.ContainerSpec.Command,
-		Args:          service.Spec.TaskTemplate.ContainerSpec.Args,
-		Env:           service.Spec.TaskTemplate.ContainerSpec.Env,
-		WorkingDir:    &service.Spec.TaskTemplate.ContainerSpec.Dir,
-		User:          &service.Spec.TaskTemplate.ContainerSpec.User,
-		Ports:         []bundlefile.Port{},
-		Networks:      []string{},
-	}
-
-	if service.Spec.Mode.Global != nil {
-		global := "global"
-		serviceBundle.Mode = &global
-	} else {
-		serviceBundle.Replicas = service.Spec.Mode.Replicated.Replicas
-	}
-
-	for _, portcfg := range service.Endpoint.Spec.Ports {
-		port := bundlefile.Port{
-			Protocol:      string(portcfg.Protocol),
-			Port:          portcfg.TargetPort,
-			PublishedPort: portcfg.PublishedPort,
-		}
-		serviceBundle.Ports = append(serviceBundle.Ports, port)
+// verifyExport checks the exported bundles round-trip through plan, printing
+// the properties of the services which can't be represented in a DAB.
+func verifyExport(swarm *client.Client, bundles map[string]*engine.Bundlefile) error {
+	if _, found := bundles[engine.GetStackName(nil)]; found {
+		yellow.Printf("Skipping verification of services without stack\n")
+	}
+
+	mismatches, err := engine.VerifyExport(context.Background(), swarm, bundles)
+	if err != nil {
+		return exitWithError(err)
 	}
 
-	for _, net := range service.Spec.Networks {
-		serviceBundle.Networks = append(serviceBundle.Networks, net.Aliases...)
+	if err := printMismatches(mismatches); err != nil {
+		return exitWithError(err)
 	}
 
-	return serviceBundle, nil
+	if len(mismatches) > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d service(s) don't round-trip through plan", len(mismatches)), exitInvalid)
+	}
+
+	color.Green("Exported stacks round-trip through plan with no changes")
+	return nil
+}
+
+// printMismatches prints the properties of the exported services which don't
+// round-trip through plan
+func printMismatches(mismatches []engine.ExportMismatch) error {
+	w := bufio.NewWriter(color.Output)
+	sp := engine.NewServicePrinter(w, false, envRedactor)
+	for _, m := range mismatches {
+		if m.Expected == nil {
+			color.Red("! %s was not exported", m.Current.Spec.Name)
+			continue
+		}
+
+		color.Red("! %s doesn't round-trip, these properties can't be represented in a DAB", m.Current.Spec.Name)
+		if _, err := sp.PrintServiceSpecDiff(m.Current.Spec, m.Expected.Spec); err != nil {
+			return err
+		}
+		w.Flush()
+		fmt.Println()
+	}
+	return nil
 }
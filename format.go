@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+const tableFormatPrefix = "table "
+
+// headerRegexp matches template actions to derive table headers from the
+// last field they reference, "{{ .Name }}" becomes "NAME"
+var headerRegexp = regexp.MustCompile(`\{\{[^}]*?\.(\w+)[^.}]*\}\}`)
+
+var formatFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// Formatter renders records with a docker like --format Go template. A
+// "table " prefix aligns the columns and prints a header.
+type Formatter struct {
+	tmpl   *template.Template
+	table  bool
+	header string
+}
+
+func NewFormatter(format string) (*Formatter, error) {
+	f := &Formatter{}
+	if strings.HasPrefix(format, tableFormatPrefix) {
+		f.table = true
+		format = strings.TrimPrefix(format, tableFormatPrefix)
+		f.header = headerRegexp.ReplaceAllStringFunc(format, func(action string) string {
+			return strings.ToUpper(headerRegexp.FindStringSubmatch(action)[1])
+		})
+	}
+
+	// Allow escaped tabs and newlines in the command line
+	format = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(format)
+	f.header = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(f.header)
+
+	tmpl, err := template.New("format").Funcs(formatFuncs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid format: %s", err)
+	}
+	f.tmpl = tmpl
+	return f, nil
+}
+
+// Write renders every record on its own line
+func (f *Formatter) Write(out io.Writer, records []interface{}) error {
+	w := out
+	var tw *tabwriter.Writer
+	if f.table {
+		tw = tabwriter.NewWriter(out, 10, 1, 3, ' ', 0)
+		w = tw
+		fmt.Fprintln(w, f.header)
+	}
+
+	for _, record := range records {
+		var line bytes.Buffer
+		if err := f.tmpl.Execute(&line, record); err != nil {
+			return fmt.Errorf("Error formatting: %s", err)
+		}
+		fmt.Fprintln(w, strings.TrimSuffix(line.String(), "\n"))
+	}
+
+	if tw != nil {
+		return tw.Flush()
+	}
+	return nil
+}
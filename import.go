@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+	"github.com/mantika/whaleprint/engine"
+	"github.com/urfave/cli"
+)
+
+// importServices adopts existing services into a stack by adding the stack
+// namespace label to them, optionally appending their definition to the
+// stack DAB.
+func importServices(c *cli.Context) error {
+	if len(c.Args()) < 2 {
+		return cli.NewExitError("A stack and at least one service must be specified", exitInvalid)
+	}
+	stackName := c.Args().First()
+	serviceNames := c.Args().Tail()
+
+	dabFile := c.String("file")
+	if dabFile == "" {
+		dabFile = fmt.Sprintf("%s.dab", stackName)
+	}
+	write := c.Bool("write")
+
+	if err := configureRedaction(c.StringSlice("redact")); err != nil {
+		return exitWithError(err)
+	}
+
+	swarmClient, swarmErr := client.NewEnvClient()
+	if swarmErr != nil {
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
+	}
+	ctx := context.Background()
+
+	bundle, err := engine.ReadBundlefile(dabFile)
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	services := []swarm.Service{}
+	for _, name := range serviceNames {
+		service, _, err := swarmClient.ServiceInspectWithRaw(ctx, name, types.ServiceInspectOptions{})
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitAPI)
+		}
+
+		if namespace, found := service.Spec.Labels["com.docker.stack.namespace"]; found && namespace != stackName {
+			return cli.NewExitError(fmt.Sprintf("Service %s already belongs to stack %s", service.Spec.Name, namespace), exitConflict)
+		}
+
+		// Labelled services missing from the DAB would be removed by the next apply
+		_, found := bundle.Services[engine.GetBundleServiceKey(service.Spec.Name, stackName)]
+		if write && found && !c.Bool("force") {
+			return cli.NewExitError(fmt.Sprintf("Service %s is already defined in %s, use --force to overwrite it", service.Spec.Name, dabFile), exitConflict)
+		} else if !write && !found {
+			return cli.NewExitError(fmt.Sprintf("Service %s is not defined in %s and the next apply would remove it, use --write to add it", service.Spec.Name, dabFile), exitConflict)
+		}
+		services = append(services, service)
+	}
+
+	if !c.Bool("auto-approve") {
+		names := make([]string, len(services))
+		for i, service := range services {
+			names[i] = service.Spec.Name
+		}
+		confirmed, err := askForConfirmation(fmt.Sprintf("Import the services into stack %s? (%s)", stackName, strings.Join(names, ", ")))
+		if err != nil {
+			return cli.NewExitError(err.Error()+", use --auto-approve to import without confirmation", exitInvalid)
+		}
+		if !confirmed {
+			return cli.NewExitError("Import cancelled", exitCancelled)
+		}
+	}
+
+	for i, service := range services {
+		color.Cyan("Importing service %s into stack %s\n", service.Spec.Name, stackName)
+		imported, err := engine.ImportService(ctx, swarmClient, service, stackName)
+		if err != nil {
+			return exitWithError(err)
+		}
+		services[i] = imported
+	}
+
+	if !write {
+		return nil
+	}
+
+	exporter, err := engine.NewExporter(ctx, swarmClient)
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	// The imported services are verified unredacted, like export does
+	verify := *bundle
+	verify.Services = map[string]engine.Service{}
+	for name, service := range bundle.Services {
+		verify.Services[name] = service
+	}
+
+	placeholders := []string{}
+	imported := map[string]bool{}
+	for _, service := range services {
+		bundleService, err := exporter.GetBundleService(service, stackName, bundle)
+		if err != nil {
+			return exitWithError(err)
+		}
+		key := engine.GetBundleServiceKey(service.Spec.Name, stackName)
+		verify.Services[key] = *bundleService
+		imported[service.Spec.Name] = true
+
+		env, names := envRedactor.Redact(bundleService.Env)
+		bundleService.Env = env
+		placeholders = append(placeholders, names...)
+
+		networks := service.Spec.Networks
+		if len(networks) == 0 {
+			networks = service.Spec.TaskTemplate.Networks
+		}
+		for _, net := range networks {
+			if name := exporter.NetworkName(net.Target); !strings.HasPrefix(name, stackName+"_") {
+				yellow.Printf("Warning: network %s of service %s doesn't belong to stack %s, plan will attach the service to %s_%s instead\n", name, service.Spec.Name, stackName, stackName, name)
+			}
+		}
+
+		bundle.Services[key] = *bundleService
+	}
+
+	if err := engine.WriteBundlefile(dabFile, bundle, true); err != nil {
+		return exitWithError(err)
+	}
+	fmt.Printf("Services written to %s, run \"whaleprint plan %s\" to check the stack is in sync\n", dabFile, stackName)
+	placeholders = dedupe(placeholders)
+	sort.Strings(placeholders)
+	printPlaceholders(os.Stdout, placeholders)
+
+	// Report what plan would still change, like custom network aliases
+	mismatches, err := engine.VerifyExport(ctx, swarmClient, map[string]*engine.Bundlefile{stackName: &verify})
+	if err != nil {
+		yellow.Printf("Warning: couldn't check the imported services round-trip through plan: %s\n", err)
+		return nil
+	}
+	importedMismatches := []engine.ExportMismatch{}
+	for _, m := range mismatches {
+		if imported[m.Current.Spec.Name] {
+			importedMismatches = append(importedMismatches, m)
+		}
+	}
+	if err := printMismatches(importedMismatches); err != nil {
+		return exitWithError(err)
+	}
+
+	return nil
+}
+
+func dedupe(values []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
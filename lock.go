@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+	"github.com/mantika/whaleprint/engine"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// lockStacks acquires the lock of every stack and returns a function which
+// releases them
+func lockStacks(w io.Writer, swarmClient *client.Client, stacks []engine.Stack, timeout time.Duration) (func(), error) {
+	wait := func(lock engine.StackLock) {
+		yellow.Fprintf(w, "Waiting for lock of stack %s, %s\n", lock.Stack, lock)
+	}
+
+	release, err := engine.LockStacks(context.Background(), swarmClient, stacks, timeout, wait)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		for _, err := range release() {
+			red.Fprintf(w, "%s\n", err)
+		}
+	}, nil
+}
+
+func lock(c *cli.Context) error {
+	update := c.Bool("update")
+	stackNames := []string(c.Args())
+	target := c.StringSlice("target")
+
+	// With --update the arguments are the services to update, the stacks are
+	// read from --file or the current directory
+	if update {
+		target = append(target, stackNames...)
+		stackNames = nil
+	}
+
+	stacks, err := loadStacks(stackNames, c.String("file"))
+	if err != nil {
+		return err
+	}
+
+	targetMap := map[string]bool{}
+	for _, name := range target {
+		if !hasService(stacks, name) {
+			return cli.NewExitError(fmt.Sprintf("Service %s not found in any stack", name), exitInvalid)
+		}
+		targetMap[name] = true
+	}
+
+	swarm, swarmErr := client.NewEnvClient()
+	if swarmErr != nil {
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
+	}
+
+	auth, err := engine.NewRegistryAuth()
+	if err != nil {
+		return exitWithError(err)
+	}
+	resolver := engine.NewDaemonImageResolver(swarm, auth)
+
+	for _, stack := range stacks {
+		lockFile, changed, err := engine.LockStack(context.Background(), resolver, stack, update, targetMap)
+		if err != nil {
+			return exitWithError(err)
+		}
+
+		for _, name := range changed {
+			locked := lockFile.Services[name]
+			color.Cyan("Locking service %s to %s@%s\n", name, locked.Image, locked.Digest)
+		}
+
+		lockPath := engine.GetLockfileName(stack.File)
+		if err := engine.WriteLockfile(lockPath, lockFile); err != nil {
+			return exitWithError(err)
+		}
+		fmt.Printf("Lockfile %s written for stack %s\n", lockPath, stack.Name)
+	}
+
+	return nil
+}
+
+// hasService reports whether any of the stacks defines the service, by DAB or
+// full service name
+func hasService(stacks []engine.Stack, name string) bool {
+	for _, stack := range stacks {
+		for key, service := range stack.Bundle.Services {
+			if key == name || engine.GetServiceName(stack.Name, key, service) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func forceUnlock(c *cli.Context) error {
+	stackNames := c.Args()
+	if len(stackNames) == 0 {
+		return cli.NewExitError("You need to specify at least one stack to unlock", exitInvalid)
+	}
+
+	swarm, swarmErr := client.NewEnvClient()
+	if swarmErr != nil {
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
+	}
+
+	for _, stackName := range stackNames {
+		lock, err := engine.GetLock(context.Background(), swarm, stackName)
+		if err != nil {
+			return exitWithError(err)
+		}
+
+		if lock == nil {
+			fmt.Printf("Stack %s is not locked\n", stackName)
+			continue
+		}
+
+		if !c.Bool("force") {
+			confirmed, err := askForConfirmation(fmt.Sprintf("Stack %s is locked, %s. Do you really want to remove the lock?", stackName, lock))
+			if err != nil {
+				return cli.NewExitError(err.Error()+", use --force to unlock without confirmation", exitInvalid)
+			}
+			if !confirmed {
+				fmt.Printf("Skipping stack %s\n", stackName)
+				continue
+			}
+		}
+
+		if err := engine.ReleaseLock(context.Background(), swarm, stackName); err != nil {
+			return exitWithError(err)
+		}
+		color.Cyan("Lock removed for stack %s\n", stackName)
+	}
+
+	return nil
+}
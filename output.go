@@ -1,48 +1,188 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
 	"github.com/fatih/color"
+	"github.com/mantika/whaleprint/engine"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
 )
 
 func output(c *cli.Context) error {
+	// "output <stack> <name>" prints a single output value, unless name is
+	// a stack of the current directory which isn't declared as an output
+	if args := c.Args(); len(args) == 2 {
+		stacks, err := loadStacks(args[:1], c.String("file"))
+		if err != nil {
+			return err
+		}
+		if _, found := stacks[0].Bundle.Outputs[args[1]]; found {
+			return printOutputValue(c, stacks[0], args[1])
+		}
+		if _, statErr := os.Stat(fmt.Sprintf("%s.dab", args[1])); c.String("file") != "" || statErr != nil {
+			return cli.NewExitError(fmt.Sprintf("Unknown output %s, it's not declared by stack %s", args[1], args[0]), exitInvalid)
+		}
+	}
+
 	stacks, err := getStacks(c)
 	if err != nil {
 		return err
 	}
 
+	var formatter *Formatter
+	if format := c.String("format"); format != "" {
+		if formatter, err = NewFormatter(format); err != nil {
+			return cli.NewExitError(err.Error(), exitInvalid)
+		}
+	}
+
 	swarm, swarmErr := client.NewEnvClient()
 	if swarmErr != nil {
-		return cli.NewExitError(swarmErr.Error(), 3)
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
 	}
 
+	collector, err := engine.NewOutputCollector(context.Background(), swarm, engine.GetIngressHost(c.String("ingress-host")))
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	values := map[string]map[string]string{}
+	records := []interface{}{}
+	failed := 0
 	for _, stack := range stacks {
-		filter := filters.NewArgs()
-		filter.Add("label", "com.docker.stack.namespace="+stack.Name)
-		services, servicesErr := swarm.ServiceList(context.Background(), types.ServiceListOptions{Filters: filter})
-		if servicesErr != nil {
-			return cli.NewExitError(servicesErr.Error(), 3)
+		outputs, err := collector.GetStackOutputs(stack.Name)
+		if err != nil {
+			return exitWithError(err)
 		}
 
-		current := getSwarmServicesSpecForStack(services)
-
-		for _, s := range current {
-			color.Green("%s\n", s.Spec.Name)
-			fmt.Println("  - Published Ports")
+		// An output which can't be computed doesn't hide the others
+		stackValues, errs := engine.EvaluateOutputs(stack, outputs, collector.IngressHost)
+		for _, name := range engine.SortedKeys(errs) {
+			failed++
+			color.New(color.FgRed).Fprintf(os.Stderr, "Stack %s: %s\n", stack.Name, errs[name])
+		}
+		values[stack.Name] = stackValues
 
-			for _, port := range s.Endpoint.Ports {
-				fmt.Printf("     %d => %d\n", port.PublishedPort, port.TargetPort)
+		if formatter != nil {
+			for _, o := range outputs {
+				records = append(records, o)
 			}
+			continue
+		}
+
+		if c.Bool("json") {
+			continue
+		}
+
+		for _, o := range outputs {
+			printServiceOutput(o)
+		}
 
+		if len(stackValues) > 0 {
+			color.Green("Outputs\n")
+			for _, name := range engine.SortedKeys(stackValues) {
+				fmt.Printf("  %s = %s\n", name, stackValues[name])
+			}
 			fmt.Println()
 		}
 	}
 
+	if formatter != nil {
+		if err := formatter.Write(os.Stdout, records); err != nil {
+			return cli.NewExitError(err.Error(), exitInvalid)
+		}
+	} else if c.Bool("json") {
+		data, err := json.MarshalIndent(values, "", "    ")
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitInvalid)
+		}
+		fmt.Println(string(data))
+	}
+
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d output(s) couldn't be computed", failed), exitInvalid)
+	}
 	return nil
 }
+
+func printOutputValue(c *cli.Context, stack engine.Stack, name string) error {
+	swarm, swarmErr := client.NewEnvClient()
+	if swarmErr != nil {
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
+	}
+
+	collector, err := engine.NewOutputCollector(context.Background(), swarm, engine.GetIngressHost(c.String("ingress-host")))
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	outputs, err := collector.GetStackOutputs(stack.Name)
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	value, err := engine.EvaluateOutput(stack, outputs, collector.IngressHost, name)
+	if err != nil {
+		return exitWithError(err)
+	}
+	fmt.Println(value)
+	return nil
+}
+
+func printServiceOutput(o engine.ServiceOutput) {
+	s := o.Service
+	color.Green("%s\n", s.Spec.Name)
+
+	fmt.Printf("  - Replicas: %d/%d\n", o.Running, o.Desired)
+	if len(o.Nodes) > 0 {
+		fmt.Printf("  - Nodes: %s\n", strings.Join(o.Nodes, ", "))
+	}
+
+	digest := o.Digest
+	if digest == "" {
+		digest = "(not pinned)"
+	}
+	fmt.Printf("  - Image: %s\n", s.Spec.TaskTemplate.ContainerSpec.Image)
+	fmt.Printf("    Digest: %s\n", digest)
+
+	if s.UpdateStatus != nil {
+		fmt.Printf("  - Last update: %s", s.UpdateStatus.State)
+		if at := getUpdateTime(s.UpdateStatus); at != nil {
+			fmt.Printf(" (%s)", at.Local().Format(time.RFC3339))
+		}
+		fmt.Println()
+		if s.UpdateStatus.Message != "" {
+			fmt.Printf("    %s\n", s.UpdateStatus.Message)
+		}
+	}
+
+	if len(o.VirtualIPs) > 0 {
+		fmt.Println("  - Virtual IPs")
+		for _, network := range engine.SortedKeys(o.VirtualIPs) {
+			fmt.Printf("     %s: %s\n", network, o.VirtualIPs[network])
+		}
+	}
+
+	if len(s.Endpoint.Ports) > 0 {
+		fmt.Println("  - Published Ports")
+		for i, port := range s.Endpoint.Ports {
+			fmt.Printf("     %d => %d/%s (%s) %s\n", port.PublishedPort, port.TargetPort, port.Protocol, port.PublishMode, o.URLs[i])
+		}
+	}
+
+	fmt.Println()
+}
+
+func getUpdateTime(status *swarm.UpdateStatus) *time.Time {
+	if status.CompletedAt != nil {
+		return status.CompletedAt
+	}
+	return status.StartedAt
+}
@@ -3,36 +3,18 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"sort"
 
 	"golang.org/x/net/context"
 
-	"github.com/docker/docker/api/client/bundlefile"
-	"github.com/docker/docker/api/client/stack"
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
 	"github.com/fatih/color"
+	"github.com/mantika/whaleprint/engine"
 	"github.com/urfave/cli"
 )
 
-var Replica1 uint64 = 1
-
-type Services map[string]swarm.Service
-
-func (s Services) Keys() []string {
-	keys := make([]string, 0, len(s))
-	for k := range s {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	return keys
-}
-
 func plan(c *cli.Context) error {
 	stacks, err := getStacks(c)
 	if err != nil {
@@ -47,193 +29,170 @@ func plan(c *cli.Context) error {
 		targetMap[name] = true
 	}
 
-	swarm, swarmErr := client.NewEnvClient()
-	if swarmErr != nil {
-		return cli.NewExitError(swarmErr.Error(), 3)
+	allowDestroy := getAllowDestroy(c)
+
+	if err := configureRedaction(c.StringSlice("redact")); err != nil {
+		return exitWithError(err)
 	}
 
-	for _, stack := range stacks {
-		filter := filters.NewArgs()
-		filter.Add("label", "com.docker.stack.namespace="+stack.Name)
-		services, servicesErr := swarm.ServiceList(context.Background(), types.ServiceListOptions{Filters: filter})
-		if servicesErr != nil {
-			return cli.NewExitError(servicesErr.Error(), 3)
+	var formatter *Formatter
+	if format := c.String("format"); format != "" {
+		if formatter, err = NewFormatter(format); err != nil {
+			return cli.NewExitError(err.Error(), exitInvalid)
 		}
+	}
 
-		expected := getBundleServicesSpec(stack.Bundle, stack.Name)
-		translateNetworkToIds(&expected, swarm, stack.Name)
-
-		current := getSwarmServicesSpecForStack(services)
-
-		w := bufio.NewWriter(os.Stdout)
-		sp := NewServicePrinter(w, detail)
-
-		for _, n := range expected.Keys() {
-			es := expected[n]
-			// Only process found target services
-			if _, found := targetMap[es.Spec.Name]; len(targetMap) == 0 || found {
-				if cs, found := current[n]; !found {
-					// New service to create
-					color.Green("+ %s", n)
-					sp.PrintServiceSpec(es.Spec)
-					w.Flush()
-					fmt.Println()
-				} else {
-					different := sp.PrintServiceSpecDiff(cs.Spec, es.Spec)
-					if different {
-						color.Yellow("~ %s\n", es.Spec.Name)
-					} else if detail {
-						color.Cyan("%s\n", es.Spec.Name)
-					}
-
-					// flush if results
-					if different || detail {
-						w.Flush()
-						fmt.Println()
-					}
-				}
-			}
-		}
+	// Keep stdout for the formatted plan, warnings and checks go to stderr
+	info := color.Output
+	if formatter != nil {
+		info = os.Stderr
+	}
 
-		// Checks services to remove
-		for _, n := range current.Keys() {
-			cs := current[n]
-			// Only process found target services
-			if _, found := targetMap[cs.Spec.Name]; len(targetMap) == 0 || found {
-				if _, found := expected[n]; !found {
-					color.Red("- %s", n)
-					sp.PrintServiceSpec(cs.Spec)
-					w.Flush()
-					fmt.Println()
-				}
-			}
+	swarm, swarmErr := client.NewEnvClient()
+	if swarmErr != nil {
+		return cli.NewExitError(swarmErr.Error(), exitAPI)
+	}
 
-		}
+	resolver, err := getImageResolver(info, c.String("resolve-image"), swarm)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitInvalid)
 	}
 
-	return nil
-}
+	if c.Bool("lock") {
+		release, err := lockStacks(info, swarm, stacks, c.Duration("lock-timeout"))
+		if err != nil {
+			return exitWithError(err)
+		}
+		defer release()
+	}
 
-func safeDereference(p *string) string {
-	if p == nil {
-		return ""
+	nodes, nodesErr := swarm.NodeList(context.Background(), types.NodeListOptions{})
+	if nodesErr != nil {
+		return cli.NewExitError(nodesErr.Error(), exitAPI)
 	}
-	return *p
-}
 
-func translateNetworkToIds(services *Services, cli *client.Client, stackName string) {
-	existingNetworks, err := stack.GetNetworks(context.Background(), cli, stackName)
-	if err != nil {
-		log.Fatal("Error retrieving networks")
+	live, liveErr := swarm.ServiceList(context.Background(), types.ServiceListOptions{})
+	if liveErr != nil {
+		return cli.NewExitError(liveErr.Error(), exitAPI)
 	}
 
-	for _, service := range *services {
-		for i, network := range service.Spec.Networks {
-			for _, enet := range existingNetworks {
-				if enet.Name == network.Target {
-					service.Spec.Networks[i].Target = enet.ID
-					network.Target = enet.ID
+	plans := []*engine.StackPlan{}
+	records := []interface{}{}
+	protectedRemovals := 0
+	placementErrors := 0
+	for _, stack := range stacks {
+		sp, err := engine.GetStackPlan(context.Background(), swarm, stack, resolver)
+		if err != nil {
+			return exitWithError(err)
+		}
+		printWarnings(info, sp.Warnings)
+
+		if formatter != nil {
+			changes, err := sp.Changes(envRedactor, targetMap, allowDestroy)
+			if err != nil {
+				return exitWithError(err)
+			}
+			for _, change := range changes {
+				if change.Protected {
+					protectedRemovals++
 				}
+				records = append(records, change)
 			}
+		} else {
+			_, protected, err := printPlan(sp, targetMap, allowDestroy, detail)
+			if err != nil {
+				return exitWithError(err)
+			}
+			protectedRemovals += protected
 		}
+		placementErrors += printPlacement(info, engine.CheckPlacement(nodes, sp.Expected.Targets(targetMap)))
+		plans = append(plans, sp)
 	}
-}
-
-func getBundleServicesSpec(bundle *bundlefile.Bundlefile, stackName string) Services {
-	specs := Services{}
-
-	for name, service := range bundle.Services {
-		spec := swarm.ServiceSpec{
-			TaskTemplate: swarm.TaskSpec{
-				ContainerSpec: swarm.ContainerSpec{
-					Image:   service.Image,
-					Labels:  map[string]string{"com.docker.stack.namespace": stackName},
-					Command: service.Command,
-					Args:    service.Args,
-					Env:     service.Env,
-					Dir:     safeDereference(service.WorkingDir),
-					User:    safeDereference(service.User),
-				},
-				Placement: &swarm.Placement{Constraints: service.Constraints},
-			},
-			Networks: convertNetworks(service.Networks, stackName, name),
-		}
 
-		spec.Mode = getServiceMode(service.Mode)
+	portConflicts := printPortConflicts(info, engine.CheckPortConflicts(live, plans))
 
-		if service.Replicas != nil {
-			spec.Mode.Replicated.Replicas = service.Replicas
+	if formatter != nil {
+		if err := formatter.Write(os.Stdout, records); err != nil {
+			return cli.NewExitError(err.Error(), exitInvalid)
 		}
+	}
 
-		spec.Labels = map[string]string{"com.docker.stack.namespace": stackName}
-
-		for name, value := range service.Labels {
-			spec.Labels[name] = value
-		}
+	if protectedRemovals > 0 {
+		return cli.NewExitError(fmt.Sprintf("Plan would destroy %d protected service(s), use --allow-destroy to allow it", protectedRemovals), exitConflict)
+	}
 
-		spec.Name = fmt.Sprintf("%s_%s", stackName, name)
+	if placementErrors > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d service(s) can't be scheduled on any node", placementErrors), exitInvalid)
+	}
 
-		// Populate ports
-		ports := []swarm.PortConfig{}
-		for _, port := range service.Ports {
-			p := swarm.PortConfig{
-				TargetPort:    port.Port,
-				Protocol:      swarm.PortConfigProtocol(port.Protocol),
-				PublishedPort: port.PublishedPort,
-			}
+	if portConflicts > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d published port conflict(s) found", portConflicts), exitConflict)
+	}
 
-			ports = append(ports, p)
-		}
-		// Hardcode resolution mode to VIP as it's the default with dab
-		mode := "vip"
-		if service.EndpointMode != nil {
-			if *service.EndpointMode != "dnsrr" && *service.EndpointMode != "vip" {
-				log.Fatalf("Invalid mode \"%s\" for service %s, only \"dnsrr\" or \"vip\" is allowed", *service.EndpointMode, spec.Name)
-			}
-			mode = *service.EndpointMode
-		}
-		spec.EndpointSpec = &swarm.EndpointSpec{Ports: ports, Mode: swarm.ResolutionMode(mode)}
+	return nil
+}
 
-		service := swarm.Service{}
-		service.ID = spec.Name
-		service.Spec = spec
+// printPlan writes the plan to stdout and returns the number of changes found
+// and how many of them are removals of protected services.
+func printPlan(p *engine.StackPlan, targetMap, allowDestroy map[string]bool, detail bool) (int, int, error) {
+	w := bufio.NewWriter(color.Output)
+	defer w.Flush()
 
-		specs[spec.Name] = service
-	}
-	return specs
+	return p.Print(engine.NewServicePrinter(w, detail, envRedactor), targetMap, allowDestroy)
 }
 
-func getServiceMode(mode *string) swarm.ServiceMode {
-	if mode != nil && *mode == "global" {
-		return swarm.ServiceMode{
-			Global: &swarm.GlobalService{},
+// printPlacement prints how many nodes are eligible for each constrained
+// service and the placement problems found. It returns the number of services
+// that can't be scheduled.
+func printPlacement(w io.Writer, checks []engine.PlacementCheck) int {
+	errors := 0
+	for _, check := range checks {
+		if check.Constrained {
+			fmt.Fprintf(w, "   %s: %d/%d nodes eligible\n", check.Service, check.Eligible, check.Nodes)
 		}
-	} else {
-		return swarm.ServiceMode{
-			Replicated: &swarm.ReplicatedService{
-				Replicas: &Replica1,
-			},
+		for _, err := range check.Errors {
+			red.Fprintf(w, "! %s: %s\n", check.Service, err)
+		}
+		for _, warning := range check.Warnings {
+			yellow.Fprintf(w, "! %s: %s\n", check.Service, warning)
+		}
+		if len(check.Errors) > 0 {
+			errors++
 		}
 	}
+	return errors
 }
 
-func convertNetworks(networks []string, namespace string, name string) []swarm.NetworkAttachmentConfig {
-	nets := []swarm.NetworkAttachmentConfig{}
-	for _, network := range networks {
-		nets = append(nets, swarm.NetworkAttachmentConfig{
-			Target:  namespace + "_" + network,
-			Aliases: []string{network, name},
-		})
+// printPortConflicts prints the published port conflicts and returns how many
+// there are
+func printPortConflicts(w io.Writer, conflicts []engine.PortConflict) int {
+	for _, conflict := range conflicts {
+		red.Fprintf(w, "! %s\n", conflict)
 	}
-	return nets
+	return len(conflicts)
 }
 
-func getSwarmServicesSpecForStack(services []swarm.Service) Services {
-	specs := Services{}
-
-	for _, service := range services {
-		specs[service.Spec.Name] = service
+func getAllowDestroy(c *cli.Context) map[string]bool {
+	allowDestroy := map[string]bool{}
+	for _, name := range c.StringSlice("allow-destroy") {
+		allowDestroy[name] = true
 	}
+	return allowDestroy
+}
 
-	return specs
+func getImageResolver(w io.Writer, resolveImage string, cli *client.Client) (engine.ImageResolver, error) {
+	switch resolveImage {
+	case "never":
+		return nil, nil
+	case "", "always":
+		// Credentials are only used to query the registry, a broken docker
+		// config shouldn't prevent resolving public images
+		auth, err := engine.NewRegistryAuth()
+		if err != nil {
+			yellow.Fprintf(w, "Warning: %s, resolving images without credentials\n", err)
+		}
+		return engine.NewDaemonImageResolver(cli, auth), nil
+	default:
+		return nil, fmt.Errorf("Invalid resolve-image option \"%s\", only \"always\" or \"never\" are allowed", resolveImage)
+	}
 }
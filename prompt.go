@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mattn/go-isatty"
+)
+
+var errNotTerminal = errors.New("Can't ask for confirmation when not running in a terminal")
+
+// askForConfirmation prompts the user to type "yes" or "no" and reports
+// whether the action was confirmed.
+func askForConfirmation(message string) (bool, error) {
+	if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+		return false, errNotTerminal
+	}
+
+	fmt.Printf("%s yes/no: ", message)
+	var input string
+	fmt.Scanln(&input)
+	switch input {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Incorrect option \"%s\", aborting", input)
+	}
+}
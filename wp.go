@@ -3,14 +3,12 @@ package main
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/docker/docker/api/client/bundlefile"
+	"github.com/fatih/color"
+	"github.com/mantika/whaleprint/engine"
 	"github.com/urfave/cli"
 )
 
@@ -30,6 +28,19 @@ Whaleprint will look for .dab files or use the stack name to load the DAB file.
 			`,
 			Action: plan,
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "resolve-image",
+					Value: "always",
+					Usage: "Pin image tags to the digest they point to in the registry (\"always\"|\"never\")",
+				},
+				cli.BoolFlag{
+					Name:  "lock",
+					Usage: "Lock the stacks while planning",
+				},
+				cli.DurationFlag{
+					Name:  "lock-timeout",
+					Usage: "Time to wait for the stack lock to be released",
+				},
 				cli.StringFlag{
 					Name:  "file, f",
 					Usage: "DAB file to use",
@@ -38,10 +49,22 @@ Whaleprint will look for .dab files or use the stack name to load the DAB file.
 					Name:  "detail",
 					Usage: "Show all properties instead of changes only",
 				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Print every change with a Go template, \"table \" prefixed to align columns",
+				},
 				cli.StringSliceFlag{
 					Name:  "target",
 					Usage: "Process specified services only (default [])",
 				},
+				cli.StringSliceFlag{
+					Name:  "allow-destroy",
+					Usage: "Allow removing the specified protected services, by DAB or full service name (default [])",
+				},
+				cli.StringSliceFlag{
+					Name:  "redact",
+					Usage: "Mask the values of environment variables matching the regexp, besides *_PASSWORD, *_TOKEN, *_KEY and *_SECRET (default [])",
+				},
 			},
 		},
 		{
@@ -50,10 +73,32 @@ Whaleprint will look for .dab files or use the stack name to load the DAB file.
 			ArgsUsage: `[STACK] [STACK...]
 
 Applies the execution plan returned by the "whaleprint plan" command
+The plan is printed and must be confirmed before applying unless --auto-approve is set.
 Whaleprint will look for .dab files or use the stack name to load the DAB file.
 			`,
 			Action: apply,
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "resolve-image",
+					Value: "always",
+					Usage: "Pin image tags to the digest they point to in the registry (\"always\"|\"never\")",
+				},
+				cli.BoolTFlag{
+					Name:  "lock",
+					Usage: "Lock the stacks while running (default true)",
+				},
+				cli.DurationFlag{
+					Name:  "lock-timeout",
+					Usage: "Time to wait for the stack lock to be released",
+				},
+				cli.BoolFlag{
+					Name:  "auto-approve",
+					Usage: "Skip interactive approval of the plan before applying",
+				},
+				cli.BoolFlag{
+					Name:  "with-registry-auth",
+					Usage: "Send registry authentication details to swarm agents (read from the docker config file or DOCKER_AUTH_CONFIG)",
+				},
 				cli.StringFlag{
 					Name:  "file, f",
 					Usage: "DAB file to use",
@@ -62,15 +107,97 @@ Whaleprint will look for .dab files or use the stack name to load the DAB file.
 					Name:  "target",
 					Usage: "Process specified services only (default [])",
 				},
+				cli.StringSliceFlag{
+					Name:  "allow-destroy",
+					Usage: "Allow removing the specified protected services, by DAB or full service name (default [])",
+				},
+				cli.StringSliceFlag{
+					Name:  "redact",
+					Usage: "Mask the values of environment variables matching the regexp, besides *_PASSWORD, *_TOKEN, *_KEY and *_SECRET (default [])",
+				},
 			},
 		},
 		{
 			Name:  "export",
-			Usage: "Export stacks to DAB",
-			ArgsUsage: `
-Exports current service definitions to a DAB file
+			Usage: "Export stacks to DAB or compose",
+			ArgsUsage: `[STACK] [STACK...]
+
+Exports current service definitions to a DAB or compose file per stack
+All stacks are exported unless some are specified.
 			`,
 			Action: export,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "label",
+					Usage: "Export services matching the label filter only, \"key\" or \"key=value\" (default [])",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "dab",
+					Usage: "Export format, \"dab\" or \"compose\" (v3)",
+				},
+				cli.StringSliceFlag{
+					Name:  "redact",
+					Usage: "Redact the values of environment variables matching the regexp, besides *_PASSWORD, *_TOKEN, *_KEY and *_SECRET (default [])",
+				},
+				cli.BoolFlag{
+					Name:  "no-redact",
+					Usage: "Export environment values verbatim",
+				},
+				cli.BoolFlag{
+					Name:  "unlabelled",
+					Usage: "Also export services without stack to services.dab",
+				},
+				cli.StringFlag{
+					Name:  "output-dir, o",
+					Value: ".",
+					Usage: "Directory to write the DAB files to",
+				},
+				cli.BoolFlag{
+					Name:  "stdout",
+					Usage: "Print the DAB to stdout instead of writing it to a file",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Overwrite existing DAB files",
+				},
+				cli.BoolFlag{
+					Name:  "verify",
+					Usage: "Check that planning the exported stacks produces no changes",
+				},
+			},
+		},
+		{
+			Name:  "import",
+			Usage: "Adopt existing services into a stack",
+			ArgsUsage: `STACK SERVICE [SERVICE...]
+
+Adds the stack namespace label to existing services so whaleprint manages them, nothing is renamed.
+With --write their definitions are added to the stack DAB so the next plan is clean.
+			`,
+			Action: importServices,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "DAB file to add the services to (default <stack>.dab)",
+				},
+				cli.BoolFlag{
+					Name:  "write, w",
+					Usage: "Add the service definitions to the DAB, required unless it already defines them",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Overwrite services already defined in the DAB",
+				},
+				cli.BoolFlag{
+					Name:  "auto-approve",
+					Usage: "Skip interactive approval before updating the services",
+				},
+				cli.StringSliceFlag{
+					Name:  "redact",
+					Usage: "Redact the values of environment variables matching the regexp, besides *_PASSWORD, *_TOKEN, *_KEY and *_SECRET (default [])",
+				},
+			},
 		},
 		{
 			Name:  "destroy",
@@ -82,6 +209,14 @@ Whaleprint will look for .dab files use the stack name to load the DAB file.
 			`,
 			Action: destroy,
 			Flags: []cli.Flag{
+				cli.BoolTFlag{
+					Name:  "lock",
+					Usage: "Lock the stacks while running (default true)",
+				},
+				cli.DurationFlag{
+					Name:  "lock-timeout",
+					Usage: "Time to wait for the stack lock to be released",
+				},
 				cli.StringFlag{
 					Name:  "file, f",
 					Usage: "DAB file to use",
@@ -94,14 +229,64 @@ Whaleprint will look for .dab files use the stack name to load the DAB file.
 					Name:  "target",
 					Usage: "Process specified services only (default [])",
 				},
+				cli.StringSliceFlag{
+					Name:  "allow-destroy",
+					Usage: "Allow removing the specified protected services, by DAB or full service name (default [])",
+				},
+			},
+		},
+		{
+			Name:  "lock",
+			Usage: "Pin stack images to digests",
+			ArgsUsage: `[STACK] [STACK...] | --update [SERVICE...]
+
+Writes a <stack>.dab.lock file next to the DAB recording the digest of every service image.
+Plan and apply use the locked digests instead of floating tags until the lock is updated.
+With --update the digests of the specified services, all of them if none, are resolved again.
+			`,
+			Action: lock,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "DAB file to use",
+				},
+				cli.BoolFlag{
+					Name:  "update",
+					Usage: "Resolve the digests of already locked images again, arguments are services instead of stacks",
+				},
+				cli.StringSliceFlag{
+					Name:  "target",
+					Usage: "Update specified services only, by DAB or full service name (default [])",
+				},
+			},
+		},
+		{
+			Name:  "force-unlock",
+			Usage: "Remove the lock of a stack",
+			ArgsUsage: `STACK [STACK...]
+
+Manually removes the lock held on the specified stacks.
+Only use it when the process holding the lock is no longer running.
+			`,
+			Action: forceUnlock,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Don't ask for confirmation",
+				},
 			},
 		},
 		{
 			Name:  "output",
 			Usage: "Show import output information stacks",
-			ArgsUsage: `[STACK] [STACK...]
+			ArgsUsage: `[STACK] [STACK...] | STACK OUTPUT
 
-Show important information for the specified stacks.
+Show important information for the specified stacks: replicas, nodes, image digest,
+last update, virtual IPs and published ports URLs of every service, and the values of
+the outputs declared in the DAB. Outputs which can't be computed are reported and
+the others still printed. When a stack and an output name are given only the output
+value is printed, two arguments are read as two stacks when the second one isn't an
+output of the first stack but has a DAB in the current directory.
 			`,
 			Action: output,
 			Flags: []cli.Flag{
@@ -109,6 +294,19 @@ Show important information for the specified stacks.
 					Name:  "file, f",
 					Usage: "DAB file to use",
 				},
+				cli.StringFlag{
+					Name:   "ingress-host",
+					EnvVar: "WHALEPRINT_INGRESS_HOST",
+					Usage:  "Host to build the published port URLs with (default DOCKER_HOST host or localhost)",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the stack outputs as JSON",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Print every service with a Go template, \"table \" prefixed to align columns",
+				},
 			},
 		},
 	}
@@ -116,28 +314,71 @@ Show important information for the specified stacks.
 	app.Run(os.Args)
 }
 
-func getStacksFromCWD() []string {
-	files, err := ioutil.ReadDir(".")
+var yellow = color.New(color.FgYellow)
+var red = color.New(color.FgRed)
+
+// envRedactor is the redactor used to mask environment variables whenever
+// service specs are printed
+var envRedactor = engine.DefaultRedactor()
+
+// configureRedaction adds the user defined patterns to the redactor used
+// when printing service specs
+func configureRedaction(patterns []string) error {
+	r, err := engine.NewRedactor(patterns)
 	if err != nil {
-		log.Fatal("Error fetching files from current dir", err)
+		return err
 	}
+	envRedactor = r
+	return nil
+}
 
-	dabs := []string{}
+func printWarnings(w io.Writer, warnings []string) {
+	for _, warning := range warnings {
+		yellow.Fprintf(w, "Warning: %s\n", warning)
+	}
+}
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".dab") {
-			dabs = append(dabs, strings.TrimSuffix(file.Name(), ".dab"))
-		}
+// Exit codes of the commands, by kind of error
+const (
+	exitInvalid   = 1 // invalid arguments, bundles or plans
+	exitLoad      = 2 // local files can't be read or written
+	exitAPI       = 3 // docker API calls failed
+	exitConflict  = 4 // locked stacks, protected services, port clashes or concurrent updates
+	exitCancelled = 5 // the confirmation was declined
+)
+
+// exitWithError returns err with the exit code of its kind
+func exitWithError(err error) error {
+	code := exitInvalid
+	switch engine.KindOf(err) {
+	case engine.LoadError:
+		code = exitLoad
+	case engine.APIError:
+		code = exitAPI
+	case engine.ConflictError:
+		code = exitConflict
+	}
+	return cli.NewExitError(err.Error(), code)
+}
+
+func getStacksFromCWD() ([]string, error) {
+	dabs, err := engine.FindStacks(".")
+	if err != nil {
+		return nil, cli.NewExitError(fmt.Sprintf("Error fetching files from current dir: %s", err), exitLoad)
 	}
 
 	if len(dabs) == 0 {
-		log.Fatal("No DABs found in current directory")
+		return nil, cli.NewExitError("No DABs found in current directory", exitLoad)
 	}
 
-	return dabs
+	return dabs, nil
+}
+
+func getStacks(c *cli.Context) ([]engine.Stack, error) {
+	return loadStacks(c.Args(), c.String("file"))
 }
 
-func getStacks(c *cli.Context) ([]Stack, error) {
+func loadStacks(stackNames []string, dabFile string) ([]engine.Stack, error) {
 	type stackDefinition struct {
 		name string
 		file string
@@ -145,12 +386,9 @@ func getStacks(c *cli.Context) ([]Stack, error) {
 
 	defs := []stackDefinition{}
 
-	stackNames := c.Args()
-	dabFile := c.String("file")
-
 	if dabFile != "" {
 		if len(stackNames) > 1 {
-			return nil, cli.NewExitError("You can only specify one stack name when using -f", 1)
+			return nil, cli.NewExitError("You can only specify one stack name when using -f", exitInvalid)
 		} else if len(stackNames) == 1 {
 			defs = append(defs, stackDefinition{name: stackNames[0], file: dabFile})
 		} else {
@@ -158,9 +396,12 @@ func getStacks(c *cli.Context) ([]Stack, error) {
 			defs = append(defs, stackDefinition{name: stackName, file: dabFile})
 		}
 	} else if len(stackNames) == 0 {
-		stackNames = getStacksFromCWD()
+		names, err := getStacksFromCWD()
+		if err != nil {
+			return nil, err
+		}
 
-		for _, name := range stackNames {
+		for _, name := range names {
 			dabFile := fmt.Sprintf("%s.dab", name)
 			defs = append(defs, stackDefinition{name: name, file: dabFile})
 		}
@@ -171,25 +412,13 @@ func getStacks(c *cli.Context) ([]Stack, error) {
 		}
 	}
 
-	stacks := make([]Stack, len(defs))
+	stacks := make([]engine.Stack, len(defs))
 	for i, def := range defs {
-		var dabReader io.Reader
-		if u, e := url.Parse(def.file); e == nil && u.IsAbs() {
-			// DAB file seems to be remote, try to download it first
-			return nil, cli.NewExitError("Not implemented", 2)
-		} else {
-			if file, err := os.Open(def.file); err != nil {
-				return nil, cli.NewExitError(err.Error(), 3)
-			} else {
-				dabReader = file
-			}
-		}
-
-		bundle, bundleErr := bundlefile.LoadFile(dabReader)
-		if bundleErr != nil {
-			return nil, cli.NewExitError(bundleErr.Error(), 3)
+		stack, err := engine.LoadStack(def.name, def.file)
+		if err != nil {
+			return nil, exitWithError(err)
 		}
-		stacks[i] = Stack{Name: def.name, Bundle: bundle}
+		stacks[i] = stack
 	}
 	return stacks, nil
 }